@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/jirwin/ctxzap"
+	"github.com/jirwin/tss-sdk-go/internal/version"
 	"go.uber.org/zap"
 )
 
@@ -23,7 +24,19 @@ func WithPasswordAuth(username, password string) ClientOption {
 		if transport == nil {
 			transport = http.DefaultTransport
 		}
-		c.httpClient.Transport = newPasswordRoundTripper(c.baseURL, username, password, transport)
+		c.httpClient.Transport = newPasswordRoundTripper(c.baseURL, c.tokenPath, username, password, transport)
+	}
+}
+
+// WithTokenPath sets the path of the OAuth2 token endpoint used by
+// WithPasswordAuth, which is /oauth2/token by default, for deployments behind
+// a reverse proxy which relocates it
+func WithTokenPath(path string) ClientOption {
+	return func(c *Client) {
+		c.tokenPath = path
+		if p, ok := c.httpClient.Transport.(*passwordAuth); ok {
+			p.passwordTs.tokenPath = path
+		}
 	}
 }
 
@@ -37,8 +50,31 @@ func WithNTLMAuth() ClientOption {
 	}
 }
 
+// WithNTLMCredentials enables NTLM authentication like WithNTLMAuth, but with
+// the given credentials instead of those of the current user. This is needed
+// for service accounts which lack a usable logon token.
+func WithNTLMCredentials(domain, username, password string) ClientOption {
+	return func(c *Client) {
+		transport := c.httpClient.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		n := newNTLMRoundTripper(transport)
+		n.domain = domain
+		n.username = username
+		n.password = password
+		c.httpClient.Transport = n
+	}
+}
+
+// SDKVersion returns the semantic version of the SDK
+func SDKVersion() string {
+	return version.SDKVersion()
+}
+
 type Client struct {
 	baseURL    string
+	tokenPath  string
 	httpClient *http.Client
 }
 
@@ -60,6 +96,17 @@ func New(baseURL string, httpClient *http.Client, opts ...ClientOption) (*Client
 	return c, nil
 }
 
+// Close releases the resources held by the client: idle connections are
+// closed and any cached token is discarded. The Client should not be used
+// after calling Close.
+func (s *Client) Close() error {
+	if p, ok := s.httpClient.Transport.(*passwordAuth); ok {
+		p.clearToken()
+	}
+	s.httpClient.CloseIdleConnections()
+	return nil
+}
+
 // accessResource uses the accessToken to access the API resource.
 // It assumes an appropriate combination of method, resource, path and input.
 func (s *Client) doRequest(ctx context.Context, method string, reqURL string, input interface{}, output interface{}) error {
@@ -86,6 +133,7 @@ func (s *Client) doRequest(ctx context.Context, method string, reqURL string, in
 		return err
 	}
 
+	req.Header.Set("User-Agent", version.UserAgent())
 	switch method {
 	case http.MethodPost, http.MethodPut, http.MethodPatch:
 		req.Header.Set("Content-Type", "application/json")
@@ -4,6 +4,11 @@ import "net/http"
 
 type ntlmAuthenticator struct {
 	originalTransport http.RoundTripper
+
+	// domain, username and password are the explicit credentials to
+	// authenticate with; when username is empty the current user's
+	// credentials are used
+	domain, username, password string
 }
 
 func newNTLMRoundTripper(originalTransport http.RoundTripper) *ntlmAuthenticator {
@@ -14,3 +19,10 @@ func newNTLMRoundTripper(originalTransport http.RoundTripper) *ntlmAuthenticator
 		originalTransport: originalTransport,
 	}
 }
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (n *ntlmAuthenticator) CloseIdleConnections() {
+	if c, ok := n.originalTransport.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -10,9 +10,26 @@ import (
 	"path"
 	"strings"
 
+	"github.com/alexbrainman/sspi"
 	"github.com/alexbrainman/sspi/ntlm"
 )
 
+// acquireUserCredentials and acquireCurrentUserCredentials acquire the NTLM
+// credentials; they are variables so that tests can observe which is used
+var (
+	acquireUserCredentials        = ntlm.AcquireUserCredentials
+	acquireCurrentUserCredentials = ntlm.AcquireCurrentUserCredentials
+)
+
+// acquireCredentials acquires the explicit credentials when they are
+// configured, falling back to the credentials of the current user
+func (n *ntlmAuthenticator) acquireCredentials() (*sspi.Credentials, error) {
+	if n.username != "" {
+		return acquireUserCredentials(n.domain, n.username, n.password)
+	}
+	return acquireCurrentUserCredentials()
+}
+
 func (n *ntlmAuthenticator) doReq(req *http.Request) (*http.Response, string, error) {
 	resp, err := n.originalTransport.RoundTrip(req)
 	if err != nil {
@@ -104,7 +121,7 @@ func (n *ntlmAuthenticator) RoundTrip(req *http.Request) (*http.Response, error)
 		req.URL.Path = path.Join("/winauthwebservices", req.URL.Path)
 	}
 
-	cred, err := ntlm.AcquireCurrentUserCredentials()
+	cred, err := n.acquireCredentials()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,60 @@
+//go:build windows
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/alexbrainman/sspi"
+)
+
+// TestNTLMCredentials asserts that the explicit credentials are acquired when
+// configured through WithNTLMCredentials, and the current user's otherwise.
+func TestNTLMCredentials(t *testing.T) {
+	errStub := errors.New("stubbed credentials")
+	var acquired string
+
+	userCredentials, currentUserCredentials := acquireUserCredentials, acquireCurrentUserCredentials
+	defer func() {
+		acquireUserCredentials, acquireCurrentUserCredentials = userCredentials, currentUserCredentials
+	}()
+	acquireUserCredentials = func(domain, username, password string) (*sspi.Credentials, error) {
+		acquired = domain + `\` + username + ":" + password
+		return nil, errStub
+	}
+	acquireCurrentUserCredentials = func() (*sspi.Credentials, error) {
+		acquired = "current user"
+		return nil, errStub
+	}
+
+	tests := []struct {
+		name     string
+		option   ClientOption
+		expected string
+	}{
+		{"CurrentUser", WithNTLMAuth(), "current user"},
+		{"Explicit", WithNTLMCredentials("CORP", "svc_tss", "Passw0rd."), `CORP\svc_tss:Passw0rd.`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acquired = ""
+			c, err := New("https://example.local/SecretServer", &http.Client{}, tt.option)
+			if err != nil {
+				t.Fatal("creating the client:", err)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, "https://example.local/api/v1/secrets/1", nil)
+			if err != nil {
+				t.Fatal("creating the request:", err)
+			}
+			if _, err := c.httpClient.Transport.RoundTrip(req); !errors.Is(err, errStub) {
+				t.Errorf("expected the stubbed credentials error, but got %v", err)
+			}
+			if acquired != tt.expected {
+				t.Errorf("expected credentials '%s' to be acquired, but found '%s'", tt.expected, acquired)
+			}
+		})
+	}
+}
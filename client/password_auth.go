@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jirwin/tss-sdk-go/internal/version"
 	"golang.org/x/oauth2"
 )
 
@@ -26,9 +27,11 @@ type tokenResp struct {
 }
 
 type passwordTokenSource struct {
-	baseURL  string
-	username string
-	password string
+	baseURL   string
+	tokenPath string
+	username  string
+	password  string
+	client    *http.Client
 }
 
 func (p *passwordTokenSource) Token() (*oauth2.Token, error) {
@@ -45,8 +48,22 @@ func (p *passwordTokenSource) Token() (*oauth2.Token, error) {
 	}
 	requestUrl.Scheme = "https"
 	requestUrl.Path = tokenPath
+	if p.tokenPath != "" {
+		requestUrl.Path = "/" + strings.TrimLeft(p.tokenPath, "/")
+	}
+
+	client := p.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodPost, requestUrl.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", version.UserAgent())
 
-	res, err := http.Post(requestUrl.String(), "application/x-www-form-urlencoded", body)
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -81,9 +98,22 @@ func (p *passwordTokenSource) Token() (*oauth2.Token, error) {
 
 type passwordAuth struct {
 	originalTransport http.RoundTripper
+	passwordTs        *passwordTokenSource
 	tokenSource       oauth2.TokenSource
 }
 
+// clearToken discards the cached token so the next request performs a new grant
+func (p *passwordAuth) clearToken() {
+	p.tokenSource = oauth2.ReuseTokenSource(nil, p.passwordTs)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (p *passwordAuth) CloseIdleConnections() {
+	if c, ok := p.originalTransport.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
 func (p *passwordAuth) RoundTrip(req *http.Request) (*http.Response, error) {
 	token, err := p.tokenSource.Token()
 	if err != nil {
@@ -95,14 +125,16 @@ func (p *passwordAuth) RoundTrip(req *http.Request) (*http.Response, error) {
 	return p.originalTransport.RoundTrip(req)
 }
 
-func newPasswordRoundTripper(baseURL, username, password string, originalTransport http.RoundTripper) *passwordAuth {
+func newPasswordRoundTripper(baseURL, tokenPath, username, password string, originalTransport http.RoundTripper) *passwordAuth {
 	passwordTs := &passwordTokenSource{
-		baseURL:  baseURL,
-		username: username,
-		password: password,
+		baseURL:   baseURL,
+		tokenPath: tokenPath,
+		username:  username,
+		password:  password,
 	}
 
 	return &passwordAuth{
+		passwordTs:        passwordTs,
 		tokenSource:       oauth2.ReuseTokenSource(nil, passwordTs),
 		originalTransport: originalTransport,
 	}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestWithTokenPath asserts that the password grant is sent to the path set by
+// WithTokenPath, whichever order the options are given in.
+func TestWithTokenPath(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != "tss-sdk-go/"+SDKVersion() {
+			t.Errorf("expected the SDK User-Agent, but found '%s'", r.UserAgent())
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/proxy/oauth2/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "test_token", "token_type": "bearer", "expires_in": 1200}`))
+	}))
+	defer ts.Close()
+
+	orders := map[string][]ClientOption{
+		"TokenPathLast":  {WithPasswordAuth("test_user", "test_password"), WithTokenPath("/proxy/oauth2/token")},
+		"TokenPathFirst": {WithTokenPath("proxy/oauth2/token"), WithPasswordAuth("test_user", "test_password")},
+	}
+	for name, opts := range orders {
+		t.Run(name, func(t *testing.T) {
+			c, err := New(ts.URL, nil, opts...)
+			if err != nil {
+				t.Fatal("creating the client:", err)
+			}
+			p, ok := c.httpClient.Transport.(*passwordAuth)
+			if !ok {
+				t.Fatal("expected the password round tripper")
+			}
+			p.passwordTs.client = ts.Client()
+
+			token, err := p.passwordTs.Token()
+			if err != nil {
+				t.Fatal("getting a token:", err)
+			}
+			if token.AccessToken != "test_token" {
+				t.Errorf("expected the access token 'test_token', but found '%s'", token.AccessToken)
+			}
+		})
+	}
+}
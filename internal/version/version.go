@@ -0,0 +1,16 @@
+// Package version holds the version of the SDK, which is shared by the client
+// and server packages
+package version
+
+// Version is the semantic version of the SDK
+const Version = "0.1.0"
+
+// SDKVersion returns the semantic version of the SDK
+func SDKVersion() string {
+	return Version
+}
+
+// UserAgent is the User-Agent header sent with the requests of the SDK
+func UserAgent() string {
+	return "tss-sdk-go/" + Version
+}
@@ -0,0 +1,23 @@
+package version
+
+import (
+	"regexp"
+	"testing"
+)
+
+// semverPattern matches a semantic version, with an optional pre-release and
+// build metadata
+var semverPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// TestVersion asserts that the version is a non-empty semantic version.
+func TestVersion(t *testing.T) {
+	if SDKVersion() == "" {
+		t.Fatal("expected a non-empty version")
+	}
+	if !semverPattern.MatchString(SDKVersion()) {
+		t.Errorf("expected a semantic version, but found '%s'", SDKVersion())
+	}
+	if UserAgent() != "tss-sdk-go/"+Version {
+		t.Errorf("expected the User-Agent to carry the version, but found '%s'", UserAgent())
+	}
+}
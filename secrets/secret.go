@@ -4,11 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/jirwin/ctxzap"
 	"go.uber.org/zap"
 )
 
+// The slugs of the fields of the built-in secret templates, for use with Field
+const (
+	FieldUsername = "username"
+	FieldPassword = "password"
+	FieldMachine  = "machine"
+	FieldDomain   = "domain"
+	FieldServer   = "server"
+	FieldURL      = "url"
+	FieldNotes    = "notes"
+)
+
 // Secret represents a secret from Delinea Secret Server
 type Secret struct {
 	Name                                                                       string
@@ -59,6 +71,82 @@ func (s *Secret) Field(ctx context.Context, fieldName string) (string, bool) {
 	return "", false
 }
 
+// FieldByName returns the value of the field whose FieldName is name, ignoring
+// slugs, which Field would also match
+func (s *Secret) FieldByName(ctx context.Context, name string) (string, bool) {
+	l := ctxzap.Extract(ctx)
+	for _, field := range s.Fields {
+		if name == field.FieldName {
+			l.Debug("field with name matches", zap.String("field_name", field.FieldName))
+			return field.ItemValue, true
+		}
+	}
+
+	l.Debug("no field with matching name", zap.String("field_name", name), zap.String("secret_name", s.Name))
+	return "", false
+}
+
+// FieldBySlug returns the value of the field whose Slug is slug, ignoring field
+// names, which Field would also match
+func (s *Secret) FieldBySlug(ctx context.Context, slug string) (string, bool) {
+	l := ctxzap.Extract(ctx)
+	for _, field := range s.Fields {
+		if slug == field.Slug {
+			l.Debug("field with slug matches", zap.String("field_slug", field.Slug))
+			return field.ItemValue, true
+		}
+	}
+
+	l.Debug("no field with matching slug", zap.String("field_slug", slug), zap.String("secret_name", s.Name))
+	return "", false
+}
+
+// FieldTrimmed returns the value of the field with the name or slug fieldName,
+// like Field, with any leading and trailing whitespace, such as the trailing
+// newline of a pasted SSH key, removed. Whitespace within the value is kept.
+func (s *Secret) FieldTrimmed(ctx context.Context, fieldName string) (string, bool) {
+	value, found := s.Field(ctx, fieldName)
+	return strings.TrimSpace(value), found
+}
+
+// DefaultFieldValueDelimiter separates the values of a multi-select list field
+const DefaultFieldValueDelimiter = ","
+
+// FieldValues returns the values of the field with the name or slug fieldName,
+// such as the selections of a multi-select list field, split on
+// DefaultFieldValueDelimiter. Each value is trimmed of whitespace and empty
+// values are dropped, so a field without a value has none.
+func (s *Secret) FieldValues(ctx context.Context, fieldName string) ([]string, bool) {
+	return s.FieldValuesWithDelimiter(ctx, fieldName, DefaultFieldValueDelimiter)
+}
+
+// FieldValuesWithDelimiter returns the values of the field like FieldValues,
+// split on the given delimiter, for servers which separate them differently
+func (s *Secret) FieldValuesWithDelimiter(ctx context.Context, fieldName, delimiter string) ([]string, bool) {
+	value, found := s.Field(ctx, fieldName)
+	if !found {
+		return nil, false
+	}
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, delimiter) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, true
+}
+
+// HasField reports whether the secret has a field with the name or slug
+// fieldName, without logging a miss like Field does
+func (s *Secret) HasField(fieldName string) bool {
+	for _, field := range s.Fields {
+		if fieldName == field.FieldName || fieldName == field.Slug {
+			return true
+		}
+	}
+	return false
+}
+
 // FieldById returns the value of the field with the given field ID
 func (s *Secret) FieldById(ctx context.Context, fieldId int) (string, bool) {
 	l := ctxzap.Extract(ctx)
@@ -73,6 +161,18 @@ func (s *Secret) FieldById(ctx context.Context, fieldId int) (string, bool) {
 	return "", false
 }
 
+// FileFields returns the fields of the secret which hold file attachments,
+// without downloading their contents
+func (s *Secret) FileFields() []SecretField {
+	var fileFields []SecretField
+	for _, field := range s.Fields {
+		if field.IsFile {
+			fileFields = append(fileFields, field)
+		}
+	}
+	return fileFields
+}
+
 // separateFileFields iterates the fields on this secret, and separates them into file
 // fields and non-file fields, using the field definitions in the given template as a
 // guide. File fields are returned as the first output, non file fields as the second
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff determines how long to wait before retrying a throttled request
+type Backoff interface {
+	// NextDelay returns the delay before the given attempt is retried, where
+	// the first attempt is 1
+	NextDelay(attempt int) time.Duration
+}
+
+// ExponentialBackoff is a full-jitter exponential Backoff: the delay before
+// each retry is chosen uniformly between zero and Base doubled for each
+// attempt, capped at Max
+type ExponentialBackoff struct {
+	Base, Max time.Duration
+}
+
+// NextDelay returns a random delay of at most Base << (attempt - 1), or Max
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	ceiling := b.Max
+	if shift := attempt - 1; shift < 63 && b.Base <= b.Max>>shift {
+		ceiling = b.Base << shift
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// ConstantBackoff is a Backoff which waits the same Delay before every retry
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// NextDelay returns Delay regardless of the attempt
+func (b ConstantBackoff) NextDelay(int) time.Duration {
+	return b.Delay
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingBackoff is a Backoff which records the attempts it is asked about
+type recordingBackoff struct {
+	mu       sync.Mutex
+	attempts []int
+}
+
+func (b *recordingBackoff) NextDelay(attempt int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts = append(b.attempts, attempt)
+	return time.Millisecond
+}
+
+// TestWithBackoff asserts that the Backoff set by WithBackoff determines the
+// delay of each retry of a throttled token request.
+func TestWithBackoff(t *testing.T) {
+	backoff := new(recordingBackoff)
+	tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}), http.NotFoundHandler(), WithBackoff(backoff))
+
+	start := time.Now()
+	if _, err := tss.getAccessToken(context.Background()); err == nil {
+		t.Error("expected an error from a token endpoint which is always throttled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the custom backoff delays to be used, but the retries took %s", elapsed)
+	}
+
+	validate("backoff calls", tokenMaxAttempts-1, len(backoff.attempts), t)
+	for i, attempt := range backoff.attempts {
+		validate("backoff attempt", i+1, attempt, t)
+	}
+
+	validate("retry-after delay", 2*time.Second, retryDelay(&http.Response{
+		Header: http.Header{"Retry-After": []string{"2"}},
+	}, 1, backoff), t)
+}
+
+// TestBackoffStrategies asserts the delays of the provided Backoff strategies.
+func TestBackoffStrategies(t *testing.T) {
+	constant := ConstantBackoff{Delay: 3 * time.Second}
+	for attempt := 1; attempt <= 3; attempt++ {
+		validate("constant delay", 3*time.Second, constant.NextDelay(attempt), t)
+	}
+
+	exponential := ExponentialBackoff{Base: 100 * time.Millisecond, Max: time.Second}
+	for attempt := 1; attempt <= 70; attempt++ {
+		ceiling := time.Second
+		if attempt <= 4 {
+			ceiling = 100 * time.Millisecond << (attempt - 1)
+		}
+		for i := 0; i < 20; i++ {
+			if delay := exponential.NextDelay(attempt); delay < 0 || delay > ceiling {
+				t.Fatalf("expected the delay of attempt %d to be within [0, %s], but found %s", attempt, ceiling, delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// ErrUnknownResource is returned when a request is made for a resource which
+// the Server does not support
+var ErrUnknownResource = errors.New("unknown resource")
+
+// ErrDeadlineExceeded is returned, along with the partial results, when the
+// budget set by WithSecretsBudget runs out; it matches context.DeadlineExceeded
+var ErrDeadlineExceeded = fmt.Errorf("the secrets budget was exceeded: %w", context.DeadlineExceeded)
+
+// ErrSecretNotFound is returned when no secret matches a lookup by something
+// other than its ID
+var ErrSecretNotFound = errors.New("secret not found")
+
+// ErrNoResults is returned by a search which matched no secrets when
+// WithNoResultsError is set
+var ErrNoResults = errors.New("the search matched no secrets")
+
+// ErrAmbiguousAlias is returned by SecretByAlias when more than one secret has
+// the alias
+var ErrAmbiguousAlias = errors.New("ambiguous secret alias")
+
+// ErrMaintenanceMode is returned when Secret Server responds that it is in
+// maintenance mode, such as during an upgrade, so that callers can back off
+var ErrMaintenanceMode = errors.New("secret server is in maintenance mode")
+
+// maintenanceMarkers are the (lowercased) fragments of an error response body
+// which indicate that Secret Server is in maintenance mode
+var maintenanceMarkers = []string{"maintenance mode", "maintenancemode", "under maintenance", "undergoing maintenance", "down for maintenance"}
+
+// isMaintenanceMode reports whether an error response is a maintenance page
+// of Secret Server. Only server errors and HTML pages are considered, so that
+// an API error which merely mentions maintenance, such as a 400 about a
+// maintenance setting, keeps its own status.
+func isMaintenanceMode(res *http.Response, data []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode < 500 && mediaType != "text/html" {
+		return false
+	}
+	body := strings.ToLower(string(data))
+	for _, marker := range maintenanceMarkers {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrMFARequired is matched (with errors.Is) by a TokenError which reports that
+// the account requires multi-factor authentication to obtain a token
+var ErrMFARequired = errors.New("multi-factor authentication is required")
+
+// ErrAccountLocked is matched (with errors.Is) by a TokenError which reports
+// that the account is locked out or disabled
+var ErrAccountLocked = errors.New("the account is locked or disabled")
+
+// ErrPasswordExpired is matched (with errors.Is) by a TokenError which reports
+// that the password of the account has expired
+var ErrPasswordExpired = errors.New("the password of the account has expired")
+
+// mfaMarkers are the (lowercased) fragments of a token error code or
+// description which indicate that multi-factor authentication is required
+var mfaMarkers = []string{"mfa", "otp", "two factor", "two-factor", "multi-factor", "one time password"}
+
+// accountLockedMarkers are the (lowercased) fragments of a token error code or
+// description which indicate that the account is locked out or disabled
+var accountLockedMarkers = []string{"locked", "disabled", "inactive", "not active"}
+
+// passwordExpiredMarkers are the (lowercased) fragments of a token error code
+// or description which indicate that the password of the account has expired
+var passwordExpiredMarkers = []string{"password expired", "password has expired", "passwordexpired", "password_expired", "password must be changed"}
+
+// TokenError is an OAuth2 error response from the token endpoint
+type TokenError struct {
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *TokenError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("error getting token (status_code: %d): %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("error getting token (status_code: %d): %s: %s", e.StatusCode, e.Code, e.Description)
+}
+
+// MFARequired reports whether the error is due to the account requiring
+// multi-factor authentication
+func (e *TokenError) MFARequired() bool {
+	return e.hasMarker(mfaMarkers)
+}
+
+// AccountLocked reports whether the error is due to the account being locked
+// out or disabled
+func (e *TokenError) AccountLocked() bool {
+	return e.hasMarker(accountLockedMarkers)
+}
+
+// PasswordExpired reports whether the error is due to the password of the
+// account having expired
+func (e *TokenError) PasswordExpired() bool {
+	return e.hasMarker(passwordExpiredMarkers)
+}
+
+// hasMarker reports whether the code or description of the error contains any
+// of the (lowercased) markers
+func (e *TokenError) hasMarker(markers []string) bool {
+	message := strings.ToLower(e.Code + " " + e.Description)
+	for _, marker := range markers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is allows errors.Is to match the TokenError against ErrMFARequired,
+// ErrAccountLocked and ErrPasswordExpired
+func (e *TokenError) Is(target error) bool {
+	switch target {
+	case ErrMFARequired:
+		return e.MFARequired()
+	case ErrAccountLocked:
+		return e.AccountLocked()
+	case ErrPasswordExpired:
+		return e.PasswordExpired()
+	}
+	return false
+}
+
+// parseTokenError parses the body of a non-2xx token endpoint response into a
+// TokenError, returning nil when the body is not an OAuth2 error response
+func parseTokenError(statusCode int, data []byte) *TokenError {
+	tokenErr := &TokenError{StatusCode: statusCode}
+	if err := json.Unmarshal(data, tokenErr); err != nil || tokenErr.Code == "" {
+		return nil
+	}
+	return tokenErr
+}
+
+// ErrCheckedOut is matched (with errors.Is) by a CheckedOutError, which is
+// returned when the secret is checked out by another user
+var ErrCheckedOut = errors.New("the secret is checked out by another user")
+
+// checkedOutMarkers are the (lowercased) fragments of an API error code or
+// message which indicate that the secret is checked out by another user
+var checkedOutMarkers = []string{"checkedout", "checked out"}
+
+// checkedOutNegations are the (lowercased) fragments of an API error code or
+// message which report that the secret is not checked out, such as when a
+// check in is refused, and so contain a checkedOutMarker without meaning it
+var checkedOutNegations = []string{"notcheckedout", "not checked out"}
+
+// CheckedOutError is an API error response reporting that the secret is
+// checked out by another user, along with who holds it and for how long
+type CheckedOutError struct {
+	StatusCode       int    `json:"-"`
+	Code             string `json:"errorCode"`
+	Message          string `json:"message"`
+	User             string `json:"checkOutUserDisplayName"`
+	MinutesRemaining int    `json:"checkOutMinutesRemaining"`
+}
+
+func (e *CheckedOutError) Error() string {
+	if e.User == "" {
+		return fmt.Sprintf("%s (status_code: %d): %s", ErrCheckedOut, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("the secret is checked out by %s for another %d minute(s) (status_code: %d): %s",
+		e.User, e.MinutesRemaining, e.StatusCode, e.Message)
+}
+
+// Is allows errors.Is to match the CheckedOutError against ErrCheckedOut
+func (e *CheckedOutError) Is(target error) bool {
+	return target == ErrCheckedOut
+}
+
+// parseCheckedOutError parses the body of a 403 API response into a
+// CheckedOutError, returning nil for any other response and when the body does
+// not report that the secret is checked out
+func parseCheckedOutError(statusCode int, data []byte) *CheckedOutError {
+	if statusCode != http.StatusForbidden {
+		return nil
+	}
+	checkedOutErr := &CheckedOutError{StatusCode: statusCode}
+	if err := json.Unmarshal(data, checkedOutErr); err != nil {
+		return nil
+	}
+	message := strings.ToLower(checkedOutErr.Code + " " + checkedOutErr.Message)
+	for _, negation := range checkedOutNegations {
+		if strings.Contains(message, negation) {
+			return nil
+		}
+	}
+	for _, marker := range checkedOutMarkers {
+		if strings.Contains(message, marker) {
+			return checkedOutErr
+		}
+	}
+	return nil
+}
+
+// StatusError is a non-2xx API response, with its body truncated to
+// errorBodyLength bytes
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// IsRetryable reports whether the operation which returned err may succeed if
+// it is retried, classifying errors the way the SDK does for its own retries:
+// 429 and 503 responses, maintenance mode, timeouts, temporary DNS failures
+// and failures to connect are retryable, while other responses, cancelled
+// contexts and unknown hosts are not. Callers implementing their own retry
+// loops can use it to stay consistent with the SDK.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrMaintenanceMode) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return retryableStatus(statusErr.StatusCode)
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return retryableStatus(apiErr.StatusCode)
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial" || errors.Is(err, syscall.ECONNRESET)
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// htmlTagPattern matches the tags of an HTML error page, which are stripped
+// from the snippet of an APIError
+var htmlTagPattern = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+
+// APIError is an error response which is not JSON, such as the HTML error page
+// of a load balancer or a web application firewall in front of Secret Server,
+// reported with its content type and a truncated snippet of its body in place
+// of an error parsing it as JSON
+type APIError struct {
+	StatusCode  int
+	Status      string
+	ContentType string
+	Snippet     string
+}
+
+func (e *APIError) Error() string {
+	if e.Snippet == "" {
+		return fmt.Sprintf("%s: unexpected %s response, which may be from a proxy or firewall in front of the server", e.Status, e.ContentType)
+	}
+	return fmt.Sprintf("%s: unexpected %s response, which may be from a proxy or firewall in front of the server: %s", e.Status, e.ContentType, e.Snippet)
+}
+
+// parseNonJSONError returns an APIError for a non-2xx response whose body is
+// not JSON, judged by its content type or, without one, by the body looking
+// like markup; it returns nil for a JSON or plain text body
+func parseNonJSONError(res *http.Response, data []byte) *APIError {
+	contentType := res.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	body := bytes.TrimSpace(data)
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return nil
+	case mediaType == "" || mediaType == "text/plain":
+		if !bytes.HasPrefix(body, []byte("<")) {
+			return nil
+		}
+		if contentType == "" {
+			contentType = "markup"
+		}
+	}
+
+	snippet := string(body)
+	if strings.Contains(mediaType, "html") || strings.Contains(mediaType, "xml") || bytes.HasPrefix(body, []byte("<")) {
+		snippet = htmlTagPattern.ReplaceAllString(snippet, " ")
+	}
+	snippet = strings.Join(strings.Fields(snippet), " ")
+	if len(snippet) > errorBodyLength {
+		snippet = snippet[:errorBodyLength] + "..."
+	}
+	return &APIError{StatusCode: res.StatusCode, Status: res.Status, ContentType: contentType, Snippet: snippet}
+}
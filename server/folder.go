@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// folderResource is the HTTP URL path component for the folders resource
+const folderResource = "folders"
+
+// defaultFolderPageSize is the number of folders requested per page when
+// FolderSearchOptions does not set Take
+const defaultFolderPageSize = 100
+
+// Folder represents a folder from Delinea Secret Server
+type Folder struct {
+	FolderName, FolderPath                  string
+	ID, ParentFolderID, FolderTypeID        int
+	SecretPolicyID                          int
+	InheritPermissions, InheritSecretPolicy bool
+}
+
+// FolderSearchOptions narrow the folders returned by Folders. Unset (zero)
+// options are omitted from the query.
+type FolderSearchOptions struct {
+	// ParentFolderID restricts the results to the children of the folder
+	ParentFolderID int
+	// SearchText restricts the results to folders whose name contains it
+	SearchText string
+	// Take is the number of folders requested per page
+	Take int
+}
+
+// folderSearchResult is a page of folders
+type folderSearchResult struct {
+	Skip, NextSkip int
+	HasNext        bool
+	Records        []Folder
+}
+
+func (p *folderSearchResult) paging() (int, bool, int) {
+	return p.NextSkip, p.HasNext, len(p.Records)
+}
+
+// Folders gets the folders that the current user can access, paging through
+// all of the results
+func (s *Server) Folders(ctx context.Context, opts FolderSearchOptions) ([]Folder, error) {
+	l := s.log(ctx)
+
+	take := opts.Take
+	if take <= 0 {
+		take = defaultFolderPageSize
+	}
+
+	folders := make([]Folder, 0)
+	err := eachPage(func(skip int) (resultPage, error) {
+		query := url.Values{
+			"skip": {strconv.Itoa(skip)},
+			"take": {strconv.Itoa(take)},
+		}
+		if opts.ParentFolderID != 0 {
+			query.Set("filter.parentFolderId", strconv.Itoa(opts.ParentFolderID))
+		}
+		if opts.SearchText != "" {
+			query.Set("filter.searchText", opts.SearchText)
+		}
+
+		page := new(folderSearchResult)
+		data, err := s.accessResource(ctx, http.MethodGet, folderResource, withQuery("/", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, page); err != nil {
+			l.Error("error parsing folders response", zap.Int("skip", skip), zap.String("data", string(data)))
+			return nil, err
+		}
+		folders = append(folders, page.Records...)
+		return page, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// TestFolders asserts that Folders pages through the folder list and sends the
+// parent folder filter.
+func TestFolders(t *testing.T) {
+	ctx := context.Background()
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/api/v1/folders/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case query.Get("filter.parentFolderId") == "2":
+			w.Write([]byte(`{"hasNext": false, "records": [
+				{"id": 3, "folderName": "Child", "folderPath": "\\Parent\\Child", "parentFolderId": 2}
+			]}`))
+		case query.Get("skip") == "0":
+			w.Write([]byte(`{"skip": 0, "nextSkip": 2, "hasNext": true, "records": [
+				{"id": 1, "folderName": "Personal Folders", "folderPath": "\\Personal Folders", "parentFolderId": -1},
+				{"id": 2, "folderName": "Parent", "folderPath": "\\Parent", "parentFolderId": -1}
+			]}`))
+		case query.Get("skip") == "2":
+			w.Write([]byte(`{"skip": 2, "nextSkip": 3, "hasNext": false, "records": [
+				{"id": 3, "folderName": "Child", "folderPath": "\\Parent\\Child", "parentFolderId": 2}
+			]}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+
+	folders, err := tss.Folders(ctx, FolderSearchOptions{Take: 2})
+	if err != nil {
+		t.Fatal("calling server.Folders:", err)
+	}
+	if len(folders) != 3 {
+		t.Fatalf("expected 3 folders across the pages, but found %d", len(folders))
+	}
+	for i, folder := range folders {
+		validate("folder id", i+1, folder.ID, t)
+	}
+	validate("folder name", "Parent", folders[1].FolderName, t)
+	validate("folder path", `\Parent\Child`, folders[2].FolderPath, t)
+
+	children, err := tss.Folders(ctx, FolderSearchOptions{ParentFolderID: 2})
+	if err != nil {
+		t.Fatal("calling server.Folders with a parent:", err)
+	}
+	if len(children) != 1 {
+		t.Fatalf("expected 1 child folder, but found %d", len(children))
+	}
+	validate("child parent folder id", 2, children[0].ParentFolderID, t)
+}
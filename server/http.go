@@ -1,13 +1,41 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jirwin/ctxzap"
+	"github.com/jirwin/tss-sdk-go/internal/version"
+	"go.uber.org/zap"
 )
 
 const errorBodyLength = 255
 
+const (
+	// tokenMaxAttempts is the number of times a token grant is attempted
+	// before a rate-limited or unavailable response is returned as an error
+	tokenMaxAttempts = 4
+	// tokenMaxRetryDelay caps both the backoff and any Retry-After delay
+	tokenMaxRetryDelay = 30 * time.Second
+	// tokenMaxRedirects is the number of redirects of the token endpoint
+	// which are followed by re-POSTing the grant
+	tokenMaxRedirects = 3
+)
+
+// tokenRetryBaseDelay is the ceiling of the delay before the first token grant
+// retry of the default backoff; it doubles with each attempt
+var tokenRetryBaseDelay = 500 * time.Millisecond
+
 // handleResponse processes the response according to the HTTP status
 func handleResponse(res *http.Response, err error) ([]byte, *http.Response, error) {
 	if err != nil { // fall-through if there was an underlying err
@@ -25,10 +53,350 @@ func handleResponse(res *http.Response, err error) ([]byte, *http.Response, erro
 		return data, res, nil
 	}
 
+	// a maintenance page is reported as such, even when it is served as a
+	// 401, so that it is not mistaken for an authentication failure
+	if isMaintenanceMode(res, data) {
+		return nil, res, fmt.Errorf("%w (%s)", ErrMaintenanceMode, res.Status)
+	}
+
+	// a secret which is checked out by another user is reported as such, so
+	// that callers can decide to wait for it to be checked in
+	if checkedOutErr := parseCheckedOutError(res.StatusCode, data); checkedOutErr != nil {
+		return nil, res, checkedOutErr
+	}
+
+	// an HTML error page of a proxy or firewall is summarized, since parsing
+	// it as JSON would fail with a cryptic error
+	if apiErr := parseNonJSONError(res, data); apiErr != nil {
+		return nil, res, apiErr
+	}
+
 	// truncate the data to errorBodyLength bytes before returning it as part of the error
 	if len(data) >= errorBodyLength {
 		data = append(data[:errorBodyLength], []byte("...")...)
 	}
 
-	return nil, res, fmt.Errorf("%s: %s", res.Status, string(data))
+	return nil, res, &StatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(data)}
+}
+
+// retryableStatus reports whether a response with the HTTP status is retried:
+// it is throttled or finds the server unavailable
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// retryable reports whether an attempt which got the response res, or failed
+// with the transport error err, is retried. It is the classification of
+// IsRetryable, shared by every retry loop of the SDK.
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return IsRetryable(err)
+	}
+	return retryableStatus(res.StatusCode)
+}
+
+// attemptDelay returns how long to wait before retrying an attempt which got
+// the response res, draining and closing its body; res is nil when the
+// attempt failed in transport.
+func attemptDelay(res *http.Response, attempt int, backoff Backoff) time.Duration {
+	if res == nil {
+		return retryDelay(&http.Response{}, attempt, backoff)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return retryDelay(res, attempt, backoff)
+}
+
+// statusCode returns the status code of res, or 0 when there is no response
+func statusCode(res *http.Response) int {
+	if res == nil {
+		return 0
+	}
+	return res.StatusCode
+}
+
+// postTokenRequest POSTs the form values to the token endpoint at tokenURL and
+// processes the response with handleResponse. Since the token endpoint is the
+// most rate limited, failures which IsRetryable classifies as retryable, such
+// as 429 and 503 responses, are retried with the backoff of the Server,
+// honoring the Retry-After header when the server sends one.
+//
+// Redirects are not followed by the client, which would turn the POST into a
+// GET without the grant; instead the grant is POSTed again to a redirect on the
+// same host, and a redirect to another host is returned as an error.
+func (s *Server) postTokenRequest(ctx context.Context, client *http.Client, tokenURL string, values url.Values) ([]byte, *http.Response, error) {
+	l := s.log(ctx)
+
+	if s.verboseLogging {
+		l.Debug("token request body", zap.String("url", tokenURL), zap.String("body", maskForm(values)))
+	}
+
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	client = &noRedirect
+	redirects := 0
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(values.Encode()))
+		if err != nil {
+			l.Error("error creating token request", zap.Error(err))
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", version.UserAgent())
+
+		res, err := client.Do(s.withHTTPTrace(req))
+		if err == nil && isRedirect(res.StatusCode) {
+			location, locErr := res.Location()
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			if locErr != nil {
+				return nil, res, fmt.Errorf("the token endpoint %s redirected (%s) without a valid Location: %w", tokenURL, res.Status, locErr)
+			}
+			if location.Host != req.URL.Host {
+				l.Error("the token endpoint redirected to another host", zap.String("url", tokenURL), zap.String("location", location.String()))
+				return nil, res, fmt.Errorf("the token endpoint %s redirected (%s) to %s; the grant is not sent to another host, so configure the URL of the token endpoint directly", tokenURL, res.Status, location)
+			}
+			if location.Scheme != req.URL.Scheme {
+				l.Error("the token endpoint redirected to another scheme", zap.String("url", tokenURL), zap.String("location", location.String()))
+				return nil, res, fmt.Errorf("the token endpoint %s redirected (%s) to %s; the grant is not sent over another scheme, so configure the URL of the token endpoint directly", tokenURL, res.Status, location)
+			}
+			if redirects++; redirects > tokenMaxRedirects {
+				return nil, res, fmt.Errorf("the token endpoint %s redirected more than %d times", tokenURL, tokenMaxRedirects)
+			}
+
+			l.Debug("the token endpoint redirected, resubmitting the grant", zap.String("url", tokenURL), zap.String("location", location.String()))
+			tokenURL = location.String()
+			attempt--
+			continue
+		}
+		if attempt < tokenMaxAttempts && retryable(res, err) {
+			delay := attemptDelay(res, attempt, s.retryBackoff())
+
+			l.Debug("token request failed, retrying",
+				zap.Int("status_code", statusCode(res)),
+				zap.Int("attempt", attempt),
+				zap.Duration("delay", delay),
+				zap.Error(err),
+			)
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		// surface OAuth2 error responses as a TokenError rather than as the
+		// generic error of handleResponse
+		if err == nil && (res.StatusCode < 200 || res.StatusCode > 299) {
+			data, readErr := io.ReadAll(res.Body)
+			res.Body.Close()
+			if readErr != nil {
+				return nil, res, readErr
+			}
+			if tokenErr := parseTokenError(res.StatusCode, data); tokenErr != nil {
+				l.Error("error response from the token endpoint", zap.Int("status_code", res.StatusCode), zap.String("error", tokenErr.Code))
+				return nil, res, tokenErr
+			}
+			res.Body = io.NopCloser(bytes.NewReader(data))
+		}
+
+		data, res, err := handleResponse(res, err)
+		if res != nil {
+			res.Body.Close()
+		}
+		if s.verboseLogging && err == nil {
+			l.Debug("token response body", zap.String("body", maskJSON(data)))
+		}
+		return data, res, err
+	}
+}
+
+// doRequest sends the API request, retrying the failures which IsRetryable
+// classifies as retryable when WithRequestRetries is set, and returns the
+// response of the last attempt with its body unread. The body of each retry is
+// rebuilt with the request's GetBody.
+func (s *Server) doRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	l := s.log(ctx)
+
+	for attempt := 1; ; attempt++ {
+		res, err := s.httpClient.Do(s.withHTTPTrace(req))
+		if attempt >= s.requestMaxAttempts || !retryable(res, err) {
+			return res, err
+		}
+
+		var body io.ReadCloser = http.NoBody
+		if req.GetBody != nil {
+			var bodyErr error
+			if body, bodyErr = req.GetBody(); bodyErr != nil {
+				l.Error("error rebuilding the request body for a retry", zap.Error(bodyErr))
+				return res, err
+			}
+		} else if req.Body != nil && req.Body != http.NoBody {
+			// the body was consumed by the first attempt and cannot be replayed
+			return res, err
+		}
+
+		delay := attemptDelay(res, attempt, s.retryBackoff())
+
+		l.Debug("request failed, retrying",
+			zap.String("method", req.Method),
+			zap.String("url", req.URL.String()),
+			zap.Int("status_code", statusCode(res)),
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			body.Close()
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		req = req.Clone(ctx)
+		req.Body = body
+	}
+}
+
+// isRedirect reports whether the HTTP status is a redirect with a Location
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// parseTokenResponse parses the token grant response according to its content
+// type, since some configurations and proxies return the grant form-encoded
+// rather than as JSON
+func parseTokenResponse(res *http.Response, data []byte) (*OAuthTokens, error) {
+	tokens := new(OAuthTokens)
+
+	var mediaType string
+	if res != nil {
+		mediaType, _, _ = mime.ParseMediaType(res.Header.Get("Content-Type"))
+	}
+	if mediaType != "application/x-www-form-urlencoded" {
+		if err := json.Unmarshal(data, tokens); err != nil {
+			return nil, err
+		}
+		return tokens, nil
+	}
+
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+	tokens.AccessToken = values.Get("access_token")
+	tokens.RefreshToken = values.Get("refresh_token")
+	tokens.IdToken = values.Get("id_token")
+	tokens.TokenType = values.Get("token_type")
+	tokens.Scope = values.Get("scope")
+	for key, value := range map[string]*int{
+		"expires_in":         &tokens.ExpiresIn,
+		"session_expires_in": &tokens.SessionExpiresIn,
+	} {
+		if values.Has(key) {
+			if *value, err = strconv.Atoi(values.Get(key)); err != nil {
+				return nil, fmt.Errorf("invalid %s '%s' in the token response", key, values.Get(key))
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// maxClockSkew is the difference between the Date of a token response and the
+// local clock beyond which the clocks are reported as skewed
+const maxClockSkew = time.Minute
+
+// tokenLifetime returns the number of seconds for which the granted token is
+// valid. When the token is a JWT, its absolute expiry is measured against the
+// Date of the response, which is the server's clock, so that a local clock
+// which is skewed from the server's does not make the cached token outlive its
+// expiry; the lifetime is the shorter of that and the grant's expires_in.
+func tokenLifetime(ctx context.Context, res *http.Response, tokens *OAuthTokens) int {
+	l := ctxzap.Extract(ctx)
+	lifetime := tokens.ExpiresIn
+
+	if res == nil {
+		return lifetime
+	}
+	serverTime, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return lifetime
+	}
+	if skew := serverTime.Sub(time.Now()); skew > maxClockSkew || skew < -maxClockSkew {
+		l.Warn("the clock of the token endpoint is skewed from the local clock", zap.Duration("skew", skew))
+	}
+
+	expiresAt, ok := jwtExpiry(tokens.AccessToken)
+	if !ok {
+		return lifetime
+	}
+	serverLifetime := int(expiresAt.Sub(serverTime) / time.Second)
+	if serverLifetime > 0 && (lifetime <= 0 || serverLifetime < lifetime) {
+		l.Debug("adjusting the token lifetime to its expiry on the server's clock",
+			zap.Int("expires_in", tokens.ExpiresIn),
+			zap.Int("lifetime", serverLifetime),
+		)
+		lifetime = serverLifetime
+	}
+	return lifetime
+}
+
+// jwtExpiry returns the exp claim of the token when it is a JWT
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// retryBackoff is the Backoff set by WithBackoff, or the default full-jitter
+// exponential backoff
+func (s *Server) retryBackoff() Backoff {
+	if s.backoff != nil {
+		return s.backoff
+	}
+	return ExponentialBackoff{Base: tokenRetryBaseDelay, Max: tokenMaxRetryDelay}
+}
+
+// retryDelay returns how long to wait before the next attempt, preferring the
+// response's Retry-After header (in seconds or as an HTTP date) over the
+// delay of the backoff for the given attempt
+func retryDelay(res *http.Response, attempt int, backoff Backoff) time.Duration {
+	delay := backoff.NextDelay(attempt)
+
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			delay = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(retryAfter); err == nil {
+			delay = time.Until(date)
+		}
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > tokenMaxRetryDelay {
+		delay = tokenMaxRetryDelay
+	}
+	return delay
 }
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestTokenRequestRetry asserts that a token grant which is throttled once is
+// retried, honoring Retry-After, and then succeeds.
+func TestTokenRequestRetry(t *testing.T) {
+	ctx := context.Background()
+	var attempts int32
+
+	tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("password") != "test_password" {
+			t.Errorf("expected the retried grant to resend the form, found %v", r.PostForm)
+		}
+		grantTestToken(w, r)
+	}), http.NotFoundHandler())
+
+	token, err := tss.getAccessToken(ctx)
+	if err != nil {
+		t.Fatal("calling server.getAccessToken:", err)
+	}
+	validate("access token", "test_token", token, t)
+	validate("token attempts", int32(2), atomic.LoadInt32(&attempts), t)
+}
+
+// TestTokenRequestRetryExhausted asserts that a token endpoint which never
+// recovers is given up on after tokenMaxAttempts.
+func TestTokenRequestRetryExhausted(t *testing.T) {
+	ctx := context.Background()
+	var attempts int32
+
+	baseDelay := tokenRetryBaseDelay
+	tokenRetryBaseDelay = time.Millisecond
+	defer func() { tokenRetryBaseDelay = baseDelay }()
+
+	tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}), http.NotFoundHandler())
+
+	if _, err := tss.getAccessToken(ctx); err == nil {
+		t.Error("expected an error from a token endpoint which is always unavailable")
+	}
+	validate("token attempts", int32(tokenMaxAttempts), atomic.LoadInt32(&attempts), t)
+}
+
+// TestTokenError asserts that OAuth2 error responses from the token endpoint
+// are returned as a TokenError, with MFA-required errors distinguishable.
+func TestTokenError(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		code        string
+		mfaRequired bool
+	}{
+		{"InvalidGrant", `{"error": "invalid_grant", "error_description": "Login failed."}`, "invalid_grant", false},
+		{"MFARequired", `{"error": "invalid_grant", "error_description": "Two-factor authentication is required. Please provide an OTP."}`, "invalid_grant", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(tt.body))
+			}), http.NotFoundHandler())
+
+			_, err := tss.getAccessToken(context.Background())
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) {
+				t.Fatalf("expected a TokenError, but got '%v'", err)
+			}
+			validate("status code", http.StatusBadRequest, tokenErr.StatusCode, t)
+			validate("error code", tt.code, tokenErr.Code, t)
+			validate("MFA required", tt.mfaRequired, errors.Is(err, ErrMFARequired), t)
+		})
+	}
+}
+
+// TestTokenErrorAccountState asserts that token errors reporting a locked or
+// disabled account or an expired password match ErrAccountLocked and
+// ErrPasswordExpired, and that other errors match neither.
+func TestTokenErrorAccountState(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		accountLocked   bool
+		passwordExpired bool
+	}{
+		{"InvalidGrant", `{"error": "invalid_grant", "error_description": "Login failed."}`, false, false},
+		{"AccountLocked", `{"error": "invalid_grant", "error_description": "Your account has been locked out due to too many failed login attempts."}`, true, false},
+		{"AccountDisabled", `{"error": "invalid_grant", "error_description": "The user account is disabled."}`, true, false},
+		{"PasswordExpired", `{"error": "invalid_grant", "error_description": "Your password has expired."}`, false, true},
+		{"PasswordExpiredCode", `{"error": "password_expired"}`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(tt.body))
+			}), http.NotFoundHandler())
+
+			_, err := tss.getAccessToken(context.Background())
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) {
+				t.Fatalf("expected a TokenError, but got '%v'", err)
+			}
+			validate("account locked", tt.accountLocked, errors.Is(err, ErrAccountLocked), t)
+			validate("password expired", tt.passwordExpired, errors.Is(err, ErrPasswordExpired), t)
+			validate("MFA required", false, errors.Is(err, ErrMFARequired), t)
+		})
+	}
+}
+
+// TestNonJSONErrorPage asserts that an HTML error page, such as that of a load
+// balancer, is returned as an APIError with its content type and a snippet of
+// its text, while a JSON error body is returned as before.
+func TestNonJSONErrorPage(t *testing.T) {
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/secrets/2" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"message": "upstream failure"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`<html>
+<head><title>502 Bad Gateway</title><style>body { color: red; }</style></head>
+<body><center><h1>502 Bad Gateway</h1></center><hr><center>nginx</center></body>
+</html>` + strings.Repeat("<!-- padding -->", 40)))
+	}))
+
+	_, err := tss.Secret(context.Background(), 1)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError, but got '%v'", err)
+	}
+	validate("status code", http.StatusBadGateway, apiErr.StatusCode, t)
+	validate("content type", "text/html; charset=utf-8", apiErr.ContentType, t)
+	validate("snippet", "502 Bad Gateway 502 Bad Gateway nginx", apiErr.Snippet, t)
+	if !strings.Contains(err.Error(), "unexpected text/html") || strings.Contains(err.Error(), "invalid character") {
+		t.Errorf("expected a useful error message, but got '%s'", err)
+	}
+
+	_, err = tss.Secret(context.Background(), 2)
+	if err == nil || errors.As(err, &apiErr) || !strings.Contains(err.Error(), "upstream failure") {
+		t.Errorf("expected the JSON error body to be returned as is, but got '%v'", err)
+	}
+}
+
+// TestIsRetryable asserts that IsRetryable classifies a 503 and temporary
+// network errors as retryable, and a 400, a cancelled context and an unknown
+// host as not.
+func TestIsRetryable(t *testing.T) {
+	responseError := func(statusCode int) error {
+		_, _, err := handleResponse(&http.Response{
+			StatusCode: statusCode,
+			Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"message": "failure"}`)),
+		}, nil)
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"503", responseError(http.StatusServiceUnavailable), true},
+		{"429", responseError(http.StatusTooManyRequests), true},
+		{"400", responseError(http.StatusBadRequest), false},
+		{"maintenance mode", fmt.Errorf("%w (500 Internal Server Error)", ErrMaintenanceMode), true},
+		{"context cancellation", &url.Error{Op: "Get", URL: "https://example.local", Err: ctx.Err()}, false},
+		{"unknown host", &url.Error{Op: "Get", URL: "https://example.local", Err: &net.OpError{
+			Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.local", IsNotFound: true},
+		}}, false},
+		{"temporary DNS failure", &net.DNSError{Err: "server misbehaving", Name: "example.local", IsTemporary: true}, true},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validate("retryable", tt.retryable, IsRetryable(tt.err), t)
+		})
+	}
+}
+
+// TestTokenClockSkew asserts that the expiry of a cached JWT is measured on the
+// clock of the token endpoint, from its Date header, when that clock is skewed
+// from the local one, and that the skew is logged.
+func TestTokenClockSkew(t *testing.T) {
+	tests := []struct {
+		name      string
+		skew      time.Duration
+		lifetime  int64
+		expiresIn int
+	}{
+		// 10% of the lifetime is cached, as for any token
+		{"server ahead", 2 * time.Hour, 1200, 1200},
+		{"server behind with a longer expires_in", -2 * time.Hour, 600, 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverTime := time.Now().Add(tt.skew)
+			claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp": %d}`, serverTime.Unix()+tt.lifetime)))
+			token := "eyJhbGciOiJub25lIn0." + claims + ".signature"
+
+			core, logs := observer.New(zapcore.DebugLevel)
+			tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Date", serverTime.UTC().Format(http.TimeFormat))
+				fmt.Fprintf(w, `{"access_token": "%s", "token_type": "bearer", "expires_in": %d}`, token, tt.expiresIn)
+			}), http.NotFoundHandler(), WithLogger(zap.New(core)))
+
+			acquired, expiresAt, err := tss.AcquireToken(context.Background())
+			if err != nil {
+				t.Fatal("calling server.AcquireToken:", err)
+			}
+			validate("token", token, acquired, t)
+			expected := time.Now().Add(time.Duration(tt.lifetime/10) * time.Second)
+			if expiresAt.Before(expected.Add(-2*time.Second)) || expiresAt.After(expected.Add(2*time.Second)) {
+				t.Errorf("expected the cached token to expire at about %s, but it expires at %s", expected, expiresAt)
+			}
+			if logs.FilterMessage("the clock of the token endpoint is skewed from the local clock").Len() != 1 {
+				t.Error("expected the clock skew to be logged")
+			}
+		})
+	}
+}
+
+// TestOTPProvider asserts that an MFA challenge from the token endpoint is
+// answered by resubmitting the grant with the one-time password.
+func TestOTPProvider(t *testing.T) {
+	var grants, otps int32
+
+	tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&grants, 1)
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("otp") != "123456" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "OTP is required."}`))
+			return
+		}
+		validate("password on the resubmitted grant", "test_password", r.PostForm.Get("password"), t)
+		grantTestToken(w, r)
+	}), http.NotFoundHandler(), WithOTPProvider(func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&otps, 1)
+		return "123456", nil
+	}))
+
+	token, err := tss.getAccessToken(context.Background())
+	if err != nil {
+		t.Fatal("calling server.getAccessToken:", err)
+	}
+	validate("access token", "test_token", token, t)
+	validate("token grants", int32(2), atomic.LoadInt32(&grants), t)
+	validate("one-time passwords", int32(1), atomic.LoadInt32(&otps), t)
+}
+
+// TestTokenResponseContentType asserts that token grants are parsed according
+// to their content type, whether JSON or form-encoded.
+func TestTokenResponseContentType(t *testing.T) {
+	tests := []struct {
+		name, contentType, body string
+	}{
+		{"JSON", "application/json; charset=utf-8", `{"access_token": "test_token", "token_type": "bearer", "expires_in": 1200}`},
+		{"Form", "application/x-www-form-urlencoded; charset=utf-8", "access_token=test_token&token_type=bearer&expires_in=1200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}), http.NotFoundHandler())
+
+			token, err := tss.getAccessToken(context.Background())
+			if err != nil {
+				t.Fatal("calling server.getAccessToken:", err)
+			}
+			validate("access token", "test_token", token, t)
+		})
+	}
+
+	res := &http.Response{Header: http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}}}
+	if _, err := parseTokenResponse(res, []byte("access_token=test_token&expires_in=soon")); err == nil {
+		t.Error("expected an error for a non-numeric expires_in")
+	}
+}
+
+// TestWriteRequestRetry asserts that a retried write resends the same body.
+func TestWriteRequestRetry(t *testing.T) {
+	var bodies []string
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/api/v1/secrets/1/general" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}), WithRequestRetries(3), WithBackoff(ConstantBackoff{Delay: time.Millisecond}))
+
+	if err := tss.PatchFields(context.Background(), 1, map[string]interface{}{"notes": "a note"}); err != nil {
+		t.Fatal("calling server.PatchFields:", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 attempts, but found %d", len(bodies))
+	}
+	if bodies[0] == "" {
+		t.Error("expected the first attempt to send the body")
+	}
+	validate("retried body", bodies[0], bodies[1], t)
+}
+
+// refusingRoundTripper fails the first request for path as a refused
+// connection and sends every other request with http.DefaultTransport
+type refusingRoundTripper struct {
+	path    string
+	refused int32
+}
+
+func (rt *refusingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == rt.path && atomic.AddInt32(&rt.refused, 1) == 1 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// TestRequestRetryTransportError asserts that a refused connection, which
+// IsRetryable classifies as retryable, is retried by WithRequestRetries.
+func TestRequestRetryTransportError(t *testing.T) {
+	rt := &refusingRoundTripper{path: "/api/v1/secrets/1"}
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1}`))
+	}), WithRoundTripper(rt), WithRequestRetries(2), WithBackoff(ConstantBackoff{Delay: time.Millisecond}))
+
+	secret, err := tss.Secret(context.Background(), 1)
+	if err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+	validate("secret id", 1, secret.ID, t)
+	validate("attempts", int32(2), atomic.LoadInt32(&rt.refused), t)
+}
+
+// TestRequestRetryDisabled asserts that API requests are not retried unless
+// WithRequestRetries is set.
+func TestRequestRetryDisabled(t *testing.T) {
+	var attempts int32
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	if _, err := tss.Secret(context.Background(), 1); err == nil {
+		t.Error("expected an error from an unavailable server")
+	}
+	validate("attempts", int32(1), atomic.LoadInt32(&attempts), t)
+}
+
+// TestWithTokenPath asserts that the token grant is sent to the path set by
+// WithTokenPath.
+func TestWithTokenPath(t *testing.T) {
+	var grants int32
+
+	tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the default token path not to be used")
+		w.WriteHeader(http.StatusNotFound)
+	}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/proxy/oauth2/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&grants, 1)
+		grantTestToken(w, r)
+	}), WithTokenPath("/proxy/oauth2/token/"))
+
+	token, err := tss.getAccessToken(context.Background())
+	if err != nil {
+		t.Fatal("calling server.getAccessToken:", err)
+	}
+	validate("access token", "test_token", token, t)
+	validate("token grants", int32(1), atomic.LoadInt32(&grants), t)
+}
+
+// TestTokenRedirect asserts that a token endpoint which redirects on the same
+// host is POSTed the grant again, and that a redirect to another host fails.
+func TestTokenRedirect(t *testing.T) {
+	t.Run("SameHost", func(t *testing.T) {
+		tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/relocated/oauth2/token", http.StatusFound)
+		}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/relocated/oauth2/token" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err := r.ParseForm(); err != nil || r.Method != http.MethodPost || r.PostForm.Get("password") != "test_password" {
+				t.Errorf("expected the grant to be POSTed to the redirect, found %s %v", r.Method, r.PostForm)
+			}
+			grantTestToken(w, r)
+		}))
+
+		token, err := tss.getAccessToken(context.Background())
+		if err != nil {
+			t.Fatal("calling server.getAccessToken:", err)
+		}
+		validate("access token", "test_token", token, t)
+	})
+
+	t.Run("OtherHost", func(t *testing.T) {
+		tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://login.example.local/oauth2/token", http.StatusFound)
+		}), http.NotFoundHandler())
+
+		_, err := tss.getAccessToken(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "another host") {
+			t.Errorf("expected an error explaining the redirect to another host, but got '%v'", err)
+		}
+	})
+
+	t.Run("Downgrade", func(t *testing.T) {
+		var cleartextGrants int32
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthcheck.aspx", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"healthy": true}`))
+		})
+		mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil {
+				atomic.AddInt32(&cleartextGrants, 1)
+				grantTestToken(w, r)
+				return
+			}
+			http.Redirect(w, r, "http://"+r.Host+"/oauth2/token", http.StatusFound)
+		})
+		ts := httptest.NewTLSServer(mux)
+		t.Cleanup(ts.Close)
+
+		tss, err := New(Configuration{
+			Credentials: UserCredential{Username: "test_user", Password: "test_password"},
+			ServerURL:   ts.URL,
+		}, WithHttpClient(ts.Client()))
+		if err != nil {
+			t.Fatal("configuring the Server:", err)
+		}
+		t.Cleanup(func() { tss.clearTokenCache(context.Background()) })
+
+		_, err = tss.getAccessToken(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "another scheme") {
+			t.Errorf("expected an error explaining the redirect to another scheme, but got '%v'", err)
+		}
+		validate("cleartext grants", int32(0), atomic.LoadInt32(&cleartextGrants), t)
+	})
+}
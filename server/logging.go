@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jirwin/ctxzap"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// log returns the logger which the Server logs with for the context: that of
+// the context, or the logger set by WithLogger, as resolved by logContext
+func (s *Server) log(ctx context.Context) *zap.Logger {
+	return ctxzap.Extract(s.logContext(ctx))
+}
+
+// logContext returns the context with the logger set by WithLogger, when there
+// is one and the context does not carry a logger of its own, so that the logs
+// of the Server are not discarded when the caller never set up ctxzap. With
+// WithLogSampling, the logger is wrapped to sample its Debug logs, once however
+// many times the context is passed through logContext. It is passed to the
+// helpers of secrets and templates, which log with the logger of the context.
+func (s *Server) logContext(ctx context.Context) context.Context {
+	hasLogger := ctxzap.Extract(ctx) != ctxzap.Extract(context.Background())
+	if s.logger != nil && !hasLogger {
+		ctx = ctxzap.ToContext(ctx, s.logger)
+		hasLogger = true
+	}
+	if s.logSampler == nil || !hasLogger || ctx.Value(sampledLoggerKey{}) == s.logSampler {
+		return ctx
+	}
+
+	logger := ctxzap.Extract(ctx).WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &debugSamplingCore{Core: core, sampler: s.logSampler}
+	}))
+	return context.WithValue(ctxzap.ToContext(ctx, logger), sampledLoggerKey{}, s.logSampler)
+}
+
+// sampledLoggerKey is the context key marking that the logger of the context
+// is already sampled by the sampler it holds
+type sampledLoggerKey struct{}
+
+// debugSampler keeps 1 in n of the Debug logs of a Server, counting across
+// every call
+type debugSampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+// sample reports whether the next Debug log is kept
+func (d *debugSampler) sample() bool {
+	return (d.count.Add(1)-1)%d.n == 0
+}
+
+// debugSamplingCore drops the Debug logs which its sampler does not keep;
+// logs at Info level and above are never sampled
+type debugSamplingCore struct {
+	zapcore.Core
+	sampler *debugSampler
+}
+
+func (c *debugSamplingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &debugSamplingCore{Core: c.Core.With(fields), sampler: c.sampler}
+}
+
+func (c *debugSamplingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Level == zapcore.DebugLevel && (!c.Core.Enabled(entry.Level) || !c.sampler.sample()) {
+		return checked
+	}
+	return c.Core.Check(entry, checked)
+}
+
+// maskedValue replaces secret values in verbose logs and the field values of a
+// secret read masked by SecretWithOptions
+const maskedValue = "*****"
+
+// sensitiveKeys are the (lowercased) JSON keys and form parameters whose values
+// are always masked in verbose logs
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"client_secret": true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"otp":           true,
+}
+
+// maskForm returns the encoded form values with the sensitive parameters
+// masked, for logging
+func maskForm(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range values[key] {
+			if sensitiveKeys[strings.ToLower(key)] {
+				value = maskedValue
+			} else {
+				value = url.QueryEscape(value)
+			}
+			pairs = append(pairs, url.QueryEscape(key)+"="+value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// maskJSON returns the JSON body with the values of every field, and of the
+// sensitive keys, masked, for logging. Field values are masked whether or not
+// the field is flagged as a password, since request bodies such as those of
+// PatchFields carry no such flag. Bodies which are not a JSON object or array,
+// such as a field value or a file attachment, are masked entirely.
+func maskJSON(data []byte) string {
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return fmt.Sprintf("<%d bytes masked>", len(data))
+	}
+
+	switch body.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return fmt.Sprintf("<%d bytes masked>", len(data))
+	}
+
+	masked, err := json.Marshal(maskValue(body))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes masked>", len(data))
+	}
+	return string(masked)
+}
+
+// maskValue walks the decoded JSON value, masking secret values in place
+func maskValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			lowerKey := strings.ToLower(key)
+			if sensitiveKeys[lowerKey] || lowerKey == "itemvalue" || lowerKey == "value" {
+				if item != nil {
+					v[key] = maskedValue
+				}
+				continue
+			}
+			v[key] = maskValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = maskValue(item)
+		}
+	}
+	return value
+}
+
+// withHTTPTrace returns the request with an httptrace.ClientTrace attached,
+// when WithHTTPTrace is set, which logs the DNS, connect, TLS handshake and
+// first response byte timings of the request at Debug level
+func (s *Server) withHTTPTrace(req *http.Request) *http.Request {
+	if !s.httpTrace {
+		return req
+	}
+
+	ctx := req.Context()
+	l := s.log(ctx).With(zap.String("method", req.Method), zap.String("url", req.URL.String()))
+	start := time.Now()
+
+	trace := &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			l.Debug("http trace: DNS done", zap.Duration("elapsed", time.Since(start)), zap.Error(info.Err))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			l.Debug("http trace: connect done", zap.String("addr", addr), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			l.Debug("http trace: TLS handshake done", zap.Uint16("tls_version", state.Version), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			l.Debug("http trace: got connection", zap.Bool("reused", info.Reused), zap.Duration("elapsed", time.Since(start)))
+		},
+		GotFirstResponseByte: func() {
+			l.Debug("http trace: first response byte", zap.Duration("elapsed", time.Since(start)))
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(ctx, trace))
+}
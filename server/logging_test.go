@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jirwin/ctxzap"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestVerboseLogging asserts that WithVerboseLogging logs the request and
+// response bodies with the password form value and the field values masked.
+func TestVerboseLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ctx := ctxzap.ToContext(context.Background(), zap.New(core))
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": [
+			{"slug": "username", "itemValue": "admin"},
+			{"slug": "password", "itemValue": "Passw0rd.", "isPassword": true}
+		]}`))
+	}), WithVerboseLogging())
+
+	if _, err := tss.Secret(ctx, 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+
+	bodies := map[string]string{}
+	for _, entry := range logs.All() {
+		if body, found := entry.ContextMap()["body"]; found {
+			bodies[entry.Message] = body.(string)
+		}
+		for _, value := range entry.ContextMap() {
+			if s, ok := value.(string); ok && (strings.Contains(s, "test_password") || strings.Contains(s, "Passw0rd.")) {
+				t.Errorf("expected no secret values in the logs, but found '%s' in '%s'", s, entry.Message)
+			}
+		}
+	}
+
+	tokenRequest, found := bodies["token request body"]
+	if !found {
+		t.Fatal("expected the token request body to be logged")
+	}
+	if !strings.Contains(tokenRequest, "password="+maskedValue) || !strings.Contains(tokenRequest, "username=test_user") {
+		t.Errorf("expected the password form value to be masked in '%s'", tokenRequest)
+	}
+
+	response, found := bodies["response body"]
+	if !found {
+		t.Fatal("expected the response body to be logged")
+	}
+	if strings.Contains(response, `"itemValue":"admin"`) || !strings.Contains(response, `"slug":"username"`) {
+		t.Errorf("expected the field values, but not the slugs, to be masked in '%s'", response)
+	}
+
+	if masked := maskJSON([]byte(`"Passw0rd."`)); strings.Contains(masked, "Passw0rd.") {
+		t.Errorf("expected a bare JSON string body to be masked, but found '%s'", masked)
+	}
+}
+
+// TestVerboseLoggingPatchFields asserts that the new values of a PatchFields
+// body, which does not flag password fields, are masked in the verbose logs.
+func TestVerboseLoggingPatchFields(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ctx := ctxzap.ToContext(context.Background(), zap.New(core))
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1}`))
+	}), WithVerboseLogging())
+
+	if err := tss.PatchFields(ctx, 1, map[string]interface{}{"password": "N3wPassw0rd."}); err != nil {
+		t.Fatal("calling server.PatchFields:", err)
+	}
+
+	logged := false
+	for _, entry := range logs.All() {
+		body, found := entry.ContextMap()["body"].(string)
+		if !found || entry.Message != "request body" {
+			continue
+		}
+		logged = true
+		if strings.Contains(body, "N3wPassw0rd.") || !strings.Contains(body, maskedValue) {
+			t.Errorf("expected the new password to be masked in '%s'", body)
+		}
+	}
+	if !logged {
+		t.Error("expected the PatchFields request body to be logged")
+	}
+}
+
+// TestHTTPTrace asserts that WithHTTPTrace logs the connection timings of the
+// token and API requests.
+func TestHTTPTrace(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ctx := ctxzap.ToContext(context.Background(), zap.New(core))
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	}), WithHTTPTrace())
+
+	if _, err := tss.Secret(ctx, 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+
+	for _, message := range []string{"http trace: got connection", "http trace: first response byte"} {
+		traced := logs.FilterMessage(message)
+		if traced.Len() < 2 {
+			t.Errorf("expected '%s' to be logged for the token and API requests, but found %d entries", message, traced.Len())
+		}
+	}
+}
+
+// TestWithLogger asserts that the logger set by WithLogger receives the logs of
+// a call whose context has no logger, and that a logger in the context takes
+// precedence over it.
+func TestWithLogger(t *testing.T) {
+	fallbackCore, fallbackLogs := observer.New(zapcore.DebugLevel)
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	}), WithLogger(zap.New(fallbackCore)))
+
+	if _, err := tss.Secret(context.Background(), 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+	if fallbackLogs.FilterMessage("calling API").Len() == 0 {
+		t.Error("expected the configured logger to receive the logs of a context without a logger")
+	}
+
+	contextCore, contextLogs := observer.New(zapcore.DebugLevel)
+	fallbackLogs.TakeAll()
+	ctx := ctxzap.ToContext(context.Background(), zap.New(contextCore))
+	if _, err := tss.Secret(ctx, 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+	if contextLogs.FilterMessage("calling API").Len() == 0 {
+		t.Error("expected the logger of the context to receive the logs")
+	}
+	validate("configured logger entries", 0, fallbackLogs.Len(), t)
+}
+
+// TestWithLogSampling asserts that WithLogSampling keeps 1 in n of the Debug
+// logs over many requests, and never samples errors.
+func TestWithLogSampling(t *testing.T) {
+	const requests, n = 50, 5
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	})
+
+	// debugLogs counts the Debug logs of the requests made with the options
+	debugLogs := func(opts ...ServerOption) int {
+		core, logs := observer.New(zapcore.DebugLevel)
+		ctx := ctxzap.ToContext(context.Background(), zap.New(core))
+		tss, _ := newTestServer(t, handler, opts...)
+		for i := 0; i < requests; i++ {
+			if _, err := tss.Secret(ctx, 1); err != nil {
+				t.Fatal("calling server.Secret:", err)
+			}
+		}
+		return logs.FilterLevelExact(zapcore.DebugLevel).Len()
+	}
+
+	all := debugLogs()
+	if all < requests {
+		t.Fatalf("expected at least %d Debug logs without sampling, but found %d", requests, all)
+	}
+	validate("sampled Debug logs", (all+n-1)/n, debugLogs(WithLogSampling(n)), t)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	tss, _ := newTestServer(t, handler, WithLogSampling(n), WithLogger(zap.New(core)))
+	l := ctxzap.Extract(tss.logContext(context.Background()))
+	for i := 0; i < requests; i++ {
+		l.Error("test error")
+	}
+	validate("Error logs", requests, logs.FilterLevelExact(zapcore.ErrorLevel).Len(), t)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sdkClientResource is the HTTP URL path component for registering SDK clients
+const sdkClientResource = "sdk-client-accounts"
+
+// sdkClientAuth is the state of SDK client authentication: the onboarding key
+// is exchanged for a client credential once, which is then used for the
+// client_credentials grant
+type sdkClientAuth struct {
+	onboardingKey, clientName string
+
+	mu         sync.Mutex
+	registered bool
+}
+
+// sdkClientCredential is the client credential issued to an SDK client
+type sdkClientCredential struct {
+	ClientID, ClientSecret string
+}
+
+// WithSDKClientAuth authenticates as a Secret Server SDK client, registering
+// the client with the given one-time onboarding key on the first request and
+// using the client credential it is issued for the client_credentials grant
+// thereafter. Since the onboarding key can only be used once, the credential
+// is kept in the TokenStore set with WithTokenStore, when there is one, so
+// that a Server created after a restart reuses it rather than registering
+// again; otherwise it is only kept by the Server.
+func WithSDKClientAuth(onboardingKey, clientName string) ServerOption {
+	return func(server *Server) {
+		server.sdkClient = &sdkClientAuth{onboardingKey: onboardingKey, clientName: clientName}
+	}
+}
+
+// registerSDKClient exchanges the onboarding key, once, for the client
+// credential of the SDK client, which is stored as the client credentials of
+// the Server
+func (s *Server) registerSDKClient(ctx context.Context) error {
+	l := s.log(ctx)
+	s.sdkClient.mu.Lock()
+	defer s.sdkClient.mu.Unlock()
+
+	if s.sdkClient.registered {
+		return nil
+	}
+
+	storeKey, err := s.sdkClientStoreKey(ctx)
+	if err != nil {
+		return err
+	}
+	if stored, found := s.storedSDKClientCredential(ctx, storeKey); found {
+		s.clientID = stored.ClientID
+		s.clientSecret = stored.ClientSecret
+		s.sdkClient.registered = true
+		l.Debug("reusing the stored SDK client credential", zap.String("client_name", s.sdkClient.clientName))
+		return nil
+	}
+
+	body, err := json.Marshal(struct {
+		OnboardingKey string `json:"onboardingKey"`
+		ClientName    string `json:"clientName"`
+	}{s.sdkClient.onboardingKey, s.sdkClient.clientName})
+	if err != nil {
+		return err
+	}
+
+	registerURL, err := s.urlFor(ctx, sdkClientResource, "register")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, registerURL, bytes.NewReader(body))
+	if err != nil {
+		l.Error("error creating SDK client registration request", zap.Error(err))
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	data, _, err := handleResponse(s.httpClient.Do(s.withHTTPTrace(req)))
+	if err != nil {
+		l.Error("error registering the SDK client", zap.String("client_name", s.sdkClient.clientName), zap.Error(err))
+		return err
+	}
+
+	credential := sdkClientCredential{}
+	if err = json.Unmarshal(data, &credential); err != nil {
+		l.Error("error parsing SDK client registration response", zap.Error(err))
+		return err
+	}
+	if credential.ClientID == "" || credential.ClientSecret == "" {
+		return fmt.Errorf("the SDK client registration of '%s' returned no client credential", s.sdkClient.clientName)
+	}
+
+	if s.tokenStore != nil {
+		stored, _ := json.Marshal(credential)
+		if err = s.tokenStore.Store(ctx, storeKey, string(stored), time.Time{}); err != nil {
+			l.Error("error storing the SDK client credential", zap.String("client_name", s.sdkClient.clientName), zap.Error(err))
+			return err
+		}
+	}
+
+	s.clientID = credential.ClientID
+	s.clientSecret = credential.ClientSecret
+	s.sdkClient.registered = true
+	l.Debug("registered the SDK client", zap.String("client_name", s.sdkClient.clientName))
+	return nil
+}
+
+// sdkClientStoreKey is the key of the TokenStore entry holding the credential
+// of the SDK client, which is kept apart from the access tokens
+func (s *Server) sdkClientStoreKey(ctx context.Context) (string, error) {
+	baseURL, err := s.serverBaseURL(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "sdk-client:" + baseURL + ":" + s.sdkClient.clientName, nil
+}
+
+// storedSDKClientCredential returns the credential of the SDK client from the
+// TokenStore, when there is one which holds it
+func (s *Server) storedSDKClientCredential(ctx context.Context, storeKey string) (sdkClientCredential, bool) {
+	credential := sdkClientCredential{}
+	if s.tokenStore == nil {
+		return credential, false
+	}
+	data, _, found := s.tokenStore.Load(ctx, storeKey)
+	if !found {
+		return credential, false
+	}
+	if err := json.Unmarshal([]byte(data), &credential); err != nil || credential.ClientID == "" || credential.ClientSecret == "" {
+		s.log(ctx).Error("error parsing the stored SDK client credential", zap.String("client_name", s.sdkClient.clientName))
+		return sdkClientCredential{}, false
+	}
+	return credential, true
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// TestSDKClientAuth asserts that WithSDKClientAuth registers the SDK client
+// once with the onboarding key, and that the issued client credential is
+// reused for every token grant.
+func TestSDKClientAuth(t *testing.T) {
+	ctx := context.Background()
+	var registrations, grants int32
+
+	tss, _ := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&grants, 1)
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		validate("grant_type", "client_credentials", r.PostForm.Get("grant_type"), t)
+		validate("client_id", "sdk-client-1234", r.PostForm.Get("client_id"), t)
+		validate("client_secret", "sdk_secret", r.PostForm.Get("client_secret"), t)
+		grantTestToken(w, r)
+	}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/sdk-client-accounts/register" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&registrations, 1)
+		registration := struct {
+			OnboardingKey, ClientName string
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil || registration.OnboardingKey != "onboarding_key" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		validate("client name", "test_client", registration.ClientName, t)
+		w.Write([]byte(`{"clientId": "sdk-client-1234", "clientSecret": "sdk_secret"}`))
+	}), WithSDKClientAuth("onboarding_key", "test_client"))
+
+	for i := 0; i < 2; i++ {
+		token, err := tss.getAccessToken(ctx)
+		if err != nil {
+			t.Fatal("calling server.getAccessToken:", err)
+		}
+		validate("access token", "test_token", token, t)
+		tss.clearTokenCache(ctx)
+	}
+	validate("registrations", int32(1), atomic.LoadInt32(&registrations), t)
+	validate("token grants", int32(2), atomic.LoadInt32(&grants), t)
+}
+
+// TestSDKClientAuthStoredCredential asserts that the client credential issued
+// to an SDK client is kept in the TokenStore, so that a Server created later,
+// as after a restart, reuses it rather than registering with the onboarding
+// key, which can only be used once.
+func TestSDKClientAuthStoredCredential(t *testing.T) {
+	ctx := context.Background()
+	var registrations int32
+	store := NewMemoryTokenStore()
+
+	tokenHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("client_id") != "sdk-client-1234" || r.PostForm.Get("client_secret") != "sdk_secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		grantTestToken(w, r)
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/sdk-client-accounts/register" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// the onboarding key is only accepted once
+		if atomic.AddInt32(&registrations, 1) > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "the onboarding key has already been used"}`))
+			return
+		}
+		w.Write([]byte(`{"clientId": "sdk-client-1234", "clientSecret": "sdk_secret"}`))
+	})
+
+	first, ts := newTestServerWithToken(t, tokenHandler, handler, WithSDKClientAuth("onboarding_key", "test_client"), WithTokenStore(store))
+	if _, err := first.getAccessToken(ctx); err != nil {
+		t.Fatal("calling server.getAccessToken:", err)
+	}
+
+	restarted, err := New(Configuration{ServerURL: ts.URL}, WithSDKClientAuth("onboarding_key", "test_client"), WithTokenStore(store))
+	if err != nil {
+		t.Fatal("configuring the restarted Server:", err)
+	}
+	restarted.clearTokenCache(ctx)
+	token, err := restarted.getAccessToken(ctx)
+	if err != nil {
+		t.Fatal("calling server.getAccessToken after a restart:", err)
+	}
+	validate("access token", "test_token", token, t)
+	validate("registrations", int32(1), atomic.LoadInt32(&registrations), t)
+}
+
+// TestSDKClientAuthWithoutCredentials asserts that WithSDKClientAuth stands in
+// for the credentials of the Configuration.
+func TestSDKClientAuthWithoutCredentials(t *testing.T) {
+	if _, err := New(Configuration{ServerURL: "https://example.local/SecretServer"}); err == nil {
+		t.Error("expected an error without credentials")
+	}
+	if _, err := New(Configuration{ServerURL: "https://example.local/SecretServer"}, WithSDKClientAuth("onboarding_key", "test_client")); err != nil {
+		t.Error("expected no error with SDK client authentication, but got:", err)
+	}
+}
@@ -1,13 +1,22 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jirwin/ctxzap"
 	"go.uber.org/zap"
@@ -16,6 +25,21 @@ import (
 // resource is the HTTP URL path component for the secrets resource
 const resource = "secrets"
 
+// The slugs of the fields of the built-in secret templates, for use with Field
+const (
+	FieldUsername = "username"
+	FieldPassword = "password"
+	FieldMachine  = "machine"
+	FieldDomain   = "domain"
+	FieldServer   = "server"
+	FieldURL      = "url"
+	FieldNotes    = "notes"
+
+	FieldPrivateKey           = "private-key"
+	FieldPublicKey            = "public-key"
+	FieldPrivateKeyPassphrase = "private-key-passphrase"
+)
+
 // Secret represents a secret from Delinea Secret Server
 type Secret struct {
 	Name                                                                       string
@@ -36,11 +60,95 @@ type SecretField struct {
 	FieldName, Slug                       string
 	FieldDescription, Filename, ItemValue string
 	IsFile, IsNotes, IsPassword           bool
+	// IsRequired is only known from the template, so it is set by
+	// EnrichFields and never sent to the server
+	IsRequired bool `json:"-"`
+}
+
+// SecretSummary is the metadata of a secret from Delinea Secret Server,
+// without its fields
+type SecretSummary struct {
+	Name, SecretTemplateName, FolderPath, LastHeartBeatStatus    string
+	ID, FolderID, SiteID, SecretTemplateID                       int
+	Active, CheckedOut, CheckOutEnabled, AutoChangeEnabled       bool
+	IsRestricted, IsOutOfSync, RequiresApproval, RequiresComment bool
 }
 
 type SearchResult struct {
-	SearchText string
-	Records    []Secret
+	SearchText     string
+	Skip, NextSkip int
+	HasNext        bool
+	Records        []Secret
+	// Total is the number of matching secrets, which is only calculated by
+	// the server when SearchFilters.CalculateTotal is set
+	Total int
+}
+
+func (p *SearchResult) paging() (int, bool, int) {
+	return p.NextSkip, p.HasNext, len(p.Records)
+}
+
+// SearchFilters narrow a secret search beyond the search text and field. Unset
+// (zero) filters are omitted from the query.
+type SearchFilters struct {
+	FolderID          int
+	IncludeSubFolders bool
+	TemplateIDs       []int
+	IncludeInactive   bool
+	HeartbeatStatus   string
+	// CalculateTotal has the server count every matching secret into
+	// SearchResult.Total, which makes the search slower
+	CalculateTotal bool
+	// ModifiedSince restricts the results to secrets modified after it
+	ModifiedSince time.Time
+	// Take is the number of records requested by each search request, 30 by
+	// default. Since the server silently caps it, a Take above MaxSearchTake
+	// is requested in pages of MaxSearchTake, which SearchSecrets collects
+	// until it has Take records.
+	Take int
+}
+
+// MaxSearchTake is the largest number of records which a search request asks
+// the server for
+const MaxSearchTake = 500
+
+// defaultSearchTake is the number of records which a search request asks the
+// server for without a Take
+const defaultSearchTake = 30
+
+// pageSize returns the number of records to request with each search request
+func (f SearchFilters) pageSize() int {
+	switch {
+	case f.Take <= 0:
+		return defaultSearchTake
+	case f.Take > MaxSearchTake:
+		return MaxSearchTake
+	}
+	return f.Take
+}
+
+// query renders the filters into the paging.filter namespace of the search
+func (f SearchFilters) query() url.Values {
+	values := url.Values{}
+	if f.FolderID != 0 {
+		values.Set("paging.filter.folderId", strconv.Itoa(f.FolderID))
+	}
+	if f.IncludeSubFolders {
+		values.Set("paging.filter.includeSubFolders", "true")
+	}
+	for _, templateID := range f.TemplateIDs {
+		values.Add("paging.filter.secretTemplateIds", strconv.Itoa(templateID))
+	}
+	if f.IncludeInactive {
+		values.Set("paging.filter.includeInactive", "true")
+	}
+	if f.HeartbeatStatus != "" {
+		values.Set("paging.filter.heartbeatStatus", f.HeartbeatStatus)
+	}
+	if !f.ModifiedSince.IsZero() {
+		values.Set("paging.filter.lastModifiedDate", f.ModifiedSince.UTC().Format(time.RFC3339))
+	}
+	return values
 }
 
 // SshKeyArgs control whether to generate an SSH key pair and a private key
@@ -52,47 +160,710 @@ type SshKeyArgs struct {
 	GeneratePassphrase, GenerateSshKeys bool
 }
 
+// NewFileField returns a file SecretField for the field with the given slug,
+// named and populated from the file at localPath. The contents are uploaded
+// as-is, so binary files are supported.
+func NewFileField(slug, localPath string) (SecretField, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return SecretField{}, err
+	}
+	defer file.Close()
+
+	return NewFileFieldFromReader(slug, filepath.Base(localPath), file)
+}
+
+// NewFileFieldFromReader returns a file SecretField for the field with the
+// given slug, with the given filename and the contents read from r
+func NewFileFieldFromReader(slug, filename string, r io.Reader) (SecretField, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return SecretField{}, err
+	}
+
+	return SecretField{
+		Slug:      slug,
+		Filename:  filename,
+		ItemValue: string(contents),
+		IsFile:    true,
+	}, nil
+}
+
 // Secret gets the secret with id from the Secret Server of the given tenant
 func (s *Server) Secret(ctx context.Context, id int) (*Secret, error) {
-	l := ctxzap.Extract(ctx)
-	secret := new(Secret)
+	secret, _, err := s.SecretRaw(ctx, id)
+	return secret, err
+}
+
+// SecretWithTemplate gets the secret with id along with its template, which
+// interprets its fields. The template is fetched through the template cache
+// when WithTemplateCache is set.
+func (s *Server) SecretWithTemplate(ctx context.Context, id int) (*Secret, *SecretTemplate, error) {
+	secret, _, err := s.readSecret(ctx, id, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := s.SecretTemplate(ctx, secret.SecretTemplateID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, template, nil
+}
+
+// SecretRaw gets the secret with id like Secret, additionally returning the raw
+// JSON body of the secret so that callers can decode attributes which Secret
+// does not model
+func (s *Server) SecretRaw(ctx context.Context, id int) (*Secret, json.RawMessage, error) {
+	return s.readSecret(ctx, id, nil)
+}
+
+// maskQueryParameter is the query parameter of a secret request which asks
+// the server for masked field values
+const maskQueryParameter = "maskValues"
 
-	if data, err := s.accessResource(ctx, http.MethodGet, resource, strconv.Itoa(id), nil); err == nil {
+// SecretReadOptions control how SecretWithOptions reads a secret. The zero
+// value reads the secret like Secret, with its real field values, which is why
+// the option is Masked rather than an Unmasked option defaulting to true.
+type SecretReadOptions struct {
+	// Masked asks the server for masked values, masks the value of every field
+	// other than a file attachment in case it returns them anyway, and
+	// downloads no file attachments, so that callers building previews never
+	// handle the real secret
+	Masked bool
+}
+
+// SecretWithOptions gets the secret with id like Secret, reading it according
+// to the options
+func (s *Server) SecretWithOptions(ctx context.Context, id int, opts SecretReadOptions) (*Secret, error) {
+	l := s.log(ctx)
+	if !opts.Masked {
+		secret, _, err := s.readSecret(ctx, id, nil)
+		return secret, err
+	}
+
+	secret := new(Secret)
+	secretPath := withQuery(strconv.Itoa(id), url.Values{maskQueryParameter: {"true"}})
+	if data, err := s.accessResource(ctx, http.MethodGet, resource, secretPath, nil); err == nil {
 		if err = json.Unmarshal(data, secret); err != nil {
-			l.Error(
-				"error parsing secret response",
-				zap.Int("secret_id", id),
-				zap.String("data", string(data)),
-			)
+			l.Error("error parsing secret response", zap.Int("secret_id", id), zap.String("data", string(data)))
 			return nil, err
 		}
 	} else {
 		return nil, err
 	}
 
+	for i, field := range secret.Fields {
+		if !field.IsFile && field.ItemValue != "" {
+			secret.Fields[i].ItemValue = maskedValue
+		}
+	}
+	return secret, nil
+}
+
+// SecretIncludeInactive gets the secret with id like Secret, but also returns
+// the secret when it is inactive (deleted) rather than failing with a 404
+func (s *Server) SecretIncludeInactive(ctx context.Context, id int) (*Secret, error) {
+	secret, _, err := s.readSecret(ctx, id, url.Values{"includeInactive": {"true"}})
+	return secret, err
+}
+
+// readSecret gets the secret with id and its raw JSON, sending the given query
+// parameters with the secret and file attachment requests
+func (s *Server) readSecret(ctx context.Context, id int, query url.Values) (*Secret, json.RawMessage, error) {
+	l := s.log(ctx)
+	secret := new(Secret)
+
+	data, err := s.accessResource(ctx, http.MethodGet, resource, withQuery(strconv.Itoa(id), query), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(data, secret); err != nil {
+		l.Error(
+			"error parsing secret response",
+			zap.Int("secret_id", id),
+			zap.String("data", string(data)),
+		)
+		return nil, nil, err
+	}
+
+	if s.skipFileDownload {
+		return secret, json.RawMessage(data), nil
+	}
+
 	// automatically download file attachments and substitute them for the
-	// (dummy) ItemValue, so as to make the process transparent to the caller
+	// (dummy) ItemValue, so as to make the process transparent to the caller.
+	// The downloads run concurrently in a requestGroup, each writing only the
+	// field at its own index. No more downloads are started once the context
+	// is done.
+	group := newRequestGroup()
 	for index, element := range secret.Fields {
-		if element.IsFile && element.FileAttachmentID != 0 && element.Filename != "" {
+		if !s.isAttachment(element) {
+			continue
+		}
+		index, element := index, element
+		started := group.Go(ctx, func() error {
 			resourcePath := path.Join(strconv.Itoa(id), "fields", element.Slug)
+			fileData, err := s.accessResource(ctx, http.MethodGet, resource, withQuery(resourcePath, query), nil)
+			if err != nil {
+				l.Error("error downloading file attachment", zap.Int("secret_id", id), zap.String("slug", element.Slug), zap.Error(err))
+				return fmt.Errorf("downloading the '%s' field: %w", element.Slug, err)
+			}
+			secret.Fields[index].ItemValue = string(fileData)
+			return nil
+		})
+		if !started {
+			break
+		}
+	}
+	err = group.Wait()
 
-			if data, err := s.accessResource(ctx, http.MethodGet, resource, resourcePath, nil); err == nil {
-				secret.Fields[index].ItemValue = string(data)
-			} else {
-				return nil, err
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		l.Error("stopped downloading file attachments", zap.Int("secret_id", id), zap.Error(ctxErr))
+		return nil, nil, ctxErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, json.RawMessage(data), nil
+}
+
+// requestConcurrency is the number of requests which a Server makes at the
+// same time for one call, such as for the file attachments of a secret
+const requestConcurrency = 4
+
+// requestGroup runs the requests of one call concurrently, at most
+// requestConcurrency at a time, collecting their errors
+type requestGroup struct {
+	wg   sync.WaitGroup
+	sem  chan struct{}
+	mu   sync.Mutex
+	errs []error
+}
+
+func newRequestGroup() *requestGroup {
+	return &requestGroup{sem: make(chan struct{}, requestConcurrency)}
+}
+
+// Go runs fn as soon as fewer than requestConcurrency functions are running.
+// It returns false, without running fn, once the context is done.
+func (g *requestGroup) Go(ctx context.Context, fn func() error) bool {
+	select {
+	case g.sem <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	if ctx.Err() != nil {
+		<-g.sem
+		return false
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() { <-g.sem }()
+		if err := fn(); err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, err)
+			g.mu.Unlock()
+		}
+	}()
+	return true
+}
+
+// Wait waits for the functions run by Go to return, and returns their errors
+// joined
+func (g *requestGroup) Wait() error {
+	g.wg.Wait()
+	return errors.Join(g.errs...)
+}
+
+// hasAttachment reports whether the field holds a file attachment to download
+func hasAttachment(field SecretField) bool {
+	return field.IsFile && field.FileAttachmentID != 0 && field.Filename != ""
+}
+
+// isAttachment reports whether the field holds a file attachment to download,
+// with the predicate set by WithFileFieldPredicate or else hasAttachment
+func (s *Server) isAttachment(field SecretField) bool {
+	if s.fileFieldPredicate != nil {
+		return s.fileFieldPredicate(field)
+	}
+	return hasAttachment(field)
+}
+
+// ResolveAttachments concurrently downloads the file attachments of an already
+// fetched secret, at most requestConcurrency at a time, returning their
+// contents keyed by field slug. It is meant to be used with
+// WithoutAutoFileDownload to fetch a secret in two phases.
+func (s *Server) ResolveAttachments(ctx context.Context, secret *Secret) (map[string][]byte, error) {
+	l := s.log(ctx)
+
+	// each download writes only the contents at the index of its field
+	contents := make([][]byte, len(secret.Fields))
+	group := newRequestGroup()
+	for index, field := range secret.Fields {
+		if !s.isAttachment(field) {
+			continue
+		}
+		index, field := index, field
+		started := group.Go(ctx, func() error {
+			resourcePath := path.Join(strconv.Itoa(secret.ID), "fields", field.Slug)
+			data, err := s.accessResource(ctx, http.MethodGet, resource, resourcePath, nil)
+			if err != nil {
+				l.Error("error downloading file attachment", zap.Int("secret_id", secret.ID), zap.String("slug", field.Slug), zap.Error(err))
+				return fmt.Errorf("downloading the '%s' field: %w", field.Slug, err)
 			}
+			contents[index] = data
+			return nil
+		})
+		if !started {
+			break
 		}
 	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	return secret, nil
+	attachments := make(map[string][]byte)
+	for index, field := range secret.Fields {
+		if s.isAttachment(field) {
+			attachments[field.Slug] = contents[index]
+		}
+	}
+	return attachments, nil
+}
+
+// AttachmentReader opens the file attachment of the field with the given slug
+// on the secret with secretID as a stream, returning it along with the
+// Content-Type sent by the server, so that callers can serve the file as-is
+// without reading it into memory. The caller must close the stream.
+func (s *Server) AttachmentReader(ctx context.Context, secretID int, slug string) (io.ReadCloser, string, error) {
+	l := s.log(ctx)
+
+	res, err := s.accessResourceResponse(ctx, http.MethodGet, resource, path.Join(strconv.Itoa(secretID), "fields", slug), nil, nil)
+	if err != nil {
+		l.Error("error opening file attachment", zap.Int("secret_id", secretID), zap.String("slug", slug), zap.Error(err))
+		return nil, "", err
+	}
+	return res.Body, res.Header.Get("Content-Type"), nil
+}
+
+// SecretStub gets an empty secret for the template with templateID, with the
+// fields of the template in place and ready to be filled in for CreateSecret
+func (s *Server) SecretStub(ctx context.Context, templateID int) (*Secret, error) {
+	l := s.log(ctx)
+	stub := new(Secret)
+
+	query := url.Values{"filter.secretTemplateId": {strconv.Itoa(templateID)}}
+	if data, err := s.accessResource(ctx, http.MethodGet, resource, withQuery("stub", query), nil); err == nil {
+		if err = json.Unmarshal(data, stub); err != nil {
+			l.Error("error parsing secret stub response", zap.Int("secret_template_id", templateID), zap.String("data", string(data)))
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return stub, nil
+}
+
+// SecretMetadata gets the summary of the secret with id, without its fields
+// and without downloading its file attachments
+func (s *Server) SecretMetadata(ctx context.Context, id int) (*SecretSummary, error) {
+	l := s.log(ctx)
+	summary := new(SecretSummary)
+
+	summaryPath := path.Join(strconv.Itoa(id), "summary")
+	if data, err := s.accessResource(ctx, http.MethodGet, resource, summaryPath, nil); err == nil {
+		if err = json.Unmarshal(data, summary); err != nil {
+			l.Error("error parsing secret summary response", zap.Int("secret_id", id), zap.String("data", string(data)))
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// SecretFieldByID gets the value of the field with the given template field ID
+// from the secret with id, without fetching the rest of the secret
+func (s *Server) SecretFieldByID(ctx context.Context, secretID, fieldID int) (string, error) {
+	l := s.log(ctx)
+
+	summary, err := s.SecretMetadata(ctx, secretID)
+	if err != nil {
+		return "", err
+	}
+
+	template, err := s.SecretTemplate(ctx, summary.SecretTemplateID)
+	if err != nil {
+		return "", err
+	}
+
+	slug, found := template.FieldIdToSlug(s.logContext(ctx), fieldID)
+	if !found {
+		l.Error("field id is not defined on the secret template", zap.Int("field_id", fieldID), zap.Int("template_id", template.ID))
+		return "", fmt.Errorf("[ERROR] field id '%d' is not defined on the secret template with id '%d'", fieldID, template.ID)
+	}
+
+	return s.secretFieldValue(ctx, secretID, slug)
+}
+
+// SecretFields gets the values of the fields with the given slugs from the
+// secret with secretID, keyed by slug. The fields are fetched concurrently, at
+// most requestConcurrency at a time, and on their own, without fetching the
+// rest of the secret or its attachments.
+func (s *Server) SecretFields(ctx context.Context, secretID int, slugs []string) (map[string]string, error) {
+	l := s.log(ctx)
+
+	var unique []string
+	requested := make(map[string]bool, len(slugs))
+	for _, slug := range slugs {
+		if !requested[slug] {
+			requested[slug] = true
+			unique = append(unique, slug)
+		}
+	}
+
+	// each fetch writes only the value at the index of its slug
+	fetched := make([]string, len(unique))
+	group := newRequestGroup()
+	for index, slug := range unique {
+		index, slug := index, slug
+		started := group.Go(ctx, func() error {
+			value, err := s.secretFieldValue(ctx, secretID, slug)
+			if err != nil {
+				l.Error("error fetching secret field", zap.Int("secret_id", secretID), zap.String("slug", slug), zap.Error(err))
+				return fmt.Errorf("fetching the '%s' field: %w", slug, err)
+			}
+			fetched[index] = value
+			return nil
+		})
+		if !started {
+			break
+		}
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(unique))
+	for index, slug := range unique {
+		values[slug] = fetched[index]
+	}
+	return values, nil
+}
+
+// secretFieldValue gets the value of the field with the given slug from the
+// secret with secretID
+func (s *Server) secretFieldValue(ctx context.Context, secretID int, slug string) (string, error) {
+	fieldPath := path.Join(strconv.Itoa(secretID), "fields", slug)
+	data, err := s.accessResource(ctx, http.MethodGet, resource, fieldPath, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// text field values are returned as a JSON string, file contents as-is
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		value = string(data)
+	}
+	return value, nil
 }
 
 // Secrets gets the secret with id from the Secret Server of the given tenant
 func (s *Server) Secrets(ctx context.Context, searchText, field string) ([]Secret, error) {
-	l := ctxzap.Extract(ctx)
+	return s.SecretsWithFilters(ctx, searchText, field, SearchFilters{})
+}
+
+// SecretsWithFilters searches for secrets like Secrets, additionally narrowing
+// the search with the given filters. When the budget set by WithSecretsBudget
+// runs out, the secrets fetched so far are returned with ErrDeadlineExceeded.
+// With WithNoResultsError, a search which matches nothing returns ErrNoResults.
+func (s *Server) SecretsWithFilters(ctx context.Context, searchText, field string, filters SearchFilters) ([]Secret, error) {
+	result, err := s.SearchSecrets(ctx, searchText, field, filters)
+	if result == nil {
+		return nil, err
+	}
+	if err == nil && s.noResultsError && result.Executed && result.Matched == 0 {
+		return result.Secrets, ErrNoResults
+	}
+	return result.Secrets, err
+}
+
+// SecretsResult is the outcome of a secret search by SearchSecrets
+type SecretsResult struct {
+	Secrets []Secret
+	// Matched is the number of search records collected, which is the first
+	// page of them unless the Take of the filters exceeds MaxSearchTake
+	Matched int
+	// Executed reports whether the server returned the records of the
+	// search, even if there were none; it is false when the response lacked
+	// them, as it does for some invalid searches such as an unknown field
+	Executed bool
+}
+
+// SearchSecrets searches for secrets like SecretsWithFilters, returning a
+// SecretsResult which distinguishes a search which found nothing from one the
+// server did not run. When the budget set by WithSecretsBudget runs out, the
+// secrets fetched so far are returned with ErrDeadlineExceeded.
+func (s *Server) SearchSecrets(ctx context.Context, searchText, field string, filters SearchFilters) (*SecretsResult, error) {
+	parent := ctx
+	if s.secretsBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.secretsBudget)
+		defer cancel()
+	}
+	// budgetExceeded reports whether the budget, rather than the caller's
+	// context, ended the operation
+	budgetExceeded := func() bool {
+		return s.secretsBudget > 0 && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil
+	}
+
+	// a Take above the maximum is satisfied by requesting more pages
+	if filters.Take > MaxSearchTake {
+		s.log(ctx).Warn("the search take exceeds the maximum, paginating",
+			zap.Int("take", filters.Take),
+			zap.Int("max_take", MaxSearchTake),
+		)
+	}
+	var searchResult *SearchResult
+	err := eachPage(func(skip int) (resultPage, error) {
+		page, err := s.searchPage(ctx, searchText, field, filters, skip)
+		if err != nil {
+			return nil, err
+		}
+		if searchResult == nil {
+			searchResult = page
+		} else {
+			searchResult.Records = append(searchResult.Records, page.Records...)
+		}
+		if filters.Take <= MaxSearchTake || len(searchResult.Records) >= filters.Take {
+			return nil, nil
+		}
+		return page, nil
+	})
+	if err != nil {
+		if budgetExceeded() {
+			return nil, ErrDeadlineExceeded
+		}
+		return nil, err
+	}
+	if filters.Take > MaxSearchTake && len(searchResult.Records) > filters.Take {
+		searchResult.Records = searchResult.Records[:filters.Take]
+	}
+
+	searchRecords := searchResult.Records
+	result := &SecretsResult{
+		Secrets:  make([]Secret, 0, len(searchRecords)),
+		Matched:  len(searchRecords),
+		Executed: searchRecords != nil,
+	}
+	if !result.Executed {
+		s.log(ctx).Debug("the search response has no records", zap.String("search_text", searchText), zap.String("field", field))
+	}
+	for _, record := range searchRecords {
+		//secrets returned in search results are not fully populated
+		secret, err := s.Secret(ctx, record.ID)
+		if err != nil {
+			if budgetExceeded() {
+				s.log(ctx).Error("the secrets budget was exceeded",
+					zap.Duration("budget", s.secretsBudget),
+					zap.Int("fetched", len(result.Secrets)),
+					zap.Int("found", len(searchRecords)),
+				)
+				return result, ErrDeadlineExceeded
+			}
+			return nil, err
+		}
+		result.Secrets = append(result.Secrets, *secret)
+	}
+
+	return result, nil
+}
+
+// SecretResult is a secret fetched by SecretsStream, or the error fetching it.
+// ID is that of the search record, so it is set even when Err is.
+type SecretResult struct {
+	ID     int
+	Secret *Secret
+	Err    error
+}
+
+// SecretsStream pages through every result of the secret search and sends each
+// secret onto out as soon as it is fetched in full, so that callers can start
+// processing a large search before it completes. The secrets are fetched
+// concurrently, so they arrive in no particular order. An error from the
+// search itself is sent with a zero ID and ends the stream. out is closed once
+// every result has been sent, or the context is done.
+func (s *Server) SecretsStream(ctx context.Context, searchText, field string, filters SearchFilters, out chan<- SecretResult) {
+	group := newRequestGroup()
+	defer close(out)
+	defer group.Wait()
+
+	send := func(result SecretResult) {
+		select {
+		case out <- result:
+		case <-ctx.Done():
+		}
+	}
+	err := eachPage(func(skip int) (resultPage, error) {
+		searchResult, err := s.searchPage(ctx, searchText, field, filters, skip)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range searchResult.Records {
+			id := record.ID
+			started := group.Go(ctx, func() error {
+				//secrets returned in search results are not fully populated
+				secret, err := s.Secret(ctx, id)
+				send(SecretResult{ID: id, Secret: secret, Err: err})
+				return nil
+			})
+			if !started {
+				return nil, nil
+			}
+		}
+		return searchResult, nil
+	})
+	if err != nil {
+		send(SecretResult{Err: err})
+	}
+}
+
+// SecretsMatchingField searches for the secrets whose field, identified by
+// name or slug, is exactly searchText. The search is exact-match already, but
+// the results are checked against the fetched secrets as well, so that records
+// the server matched loosely are left out.
+func (s *Server) SecretsMatchingField(ctx context.Context, searchText, field string) ([]Secret, error) {
+	if field == "" {
+		return nil, errors.New("a field is required to match secrets on")
+	}
+
+	result, err := s.SearchSecrets(ctx, searchText, field, SearchFilters{})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]Secret, 0, len(result.Secrets))
+	for _, secret := range result.Secrets {
+		if secret.fieldMatches(field, searchText) {
+			matches = append(matches, secret)
+		} else {
+			s.log(ctx).Debug("leaving out a search result without a matching field",
+				zap.Int("secret_id", secret.ID),
+				zap.String("field", field),
+			)
+		}
+	}
+	return matches, nil
+}
+
+// aliasField is the slug of the field which holds the textual alias of a
+// secret, for SecretByAlias
+const aliasField = "alias"
+
+// SecretByAlias gets the single secret whose alias field is exactly alias. It
+// returns an error matching ErrSecretNotFound when no secret has the alias,
+// and ErrAmbiguousAlias when more than one does.
+func (s *Server) SecretByAlias(ctx context.Context, alias string) (*Secret, error) {
+	secrets, err := s.SecretsMatchingField(ctx, alias, aliasField)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(secrets) {
+	case 0:
+		return nil, fmt.Errorf("%w: no secret has the alias '%s'", ErrSecretNotFound, alias)
+	case 1:
+		return &secrets[0], nil
+	default:
+		ids := make([]string, len(secrets))
+		for i, secret := range secrets {
+			ids[i] = strconv.Itoa(secret.ID)
+		}
+		s.log(ctx).Error("more than one secret has the alias", zap.String("alias", alias), zap.Strings("secret_ids", ids))
+		return nil, fmt.Errorf("%w: the alias '%s' is shared by the secrets %s", ErrAmbiguousAlias, alias, strings.Join(ids, ", "))
+	}
+}
+
+// fieldMatches reports whether any field with the name or slug fieldName has
+// exactly the given value
+func (s *Secret) fieldMatches(fieldName, value string) bool {
+	for _, field := range s.Fields {
+		if (fieldName == field.FieldName || fieldName == field.Slug) && field.ItemValue == value {
+			return true
+		}
+	}
+	return false
+}
+
+// summarySearchResult is a page of secret search results parsed as summaries
+type summarySearchResult struct {
+	NextSkip int
+	HasNext  bool
+	Records  []SecretSummary
+}
+
+func (p *summarySearchResult) paging() (int, bool, int) {
+	return p.NextSkip, p.HasNext, len(p.Records)
+}
+
+// SecretsModifiedSince pages through the secrets modified after since, which
+// also narrows the search by the other filters, for incremental syncs. It
+// returns the summaries of the search, without fetching each secret in full.
+func (s *Server) SecretsModifiedSince(ctx context.Context, since time.Time, filters SearchFilters) ([]SecretSummary, error) {
+	l := s.log(ctx)
+	if since.IsZero() {
+		return nil, errors.New("a time is required to search for the secrets modified since")
+	}
+	filters.ModifiedSince = since
+
+	summaries := make([]SecretSummary, 0)
+	err := eachPage(func(skip int) (resultPage, error) {
+		data, err := s.searchResources(ctx, resource, "", "", filters, skip)
+		if err != nil {
+			return nil, err
+		}
+		page := new(summarySearchResult)
+		if err = json.Unmarshal(data, page); err != nil {
+			l.Error("error parsing secret search response", zap.Time("since", since), zap.String("data", string(data)))
+			return nil, err
+		}
+		summaries = append(summaries, page.Records...)
+		return page, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// SearchTotal returns the number of secrets which match the search, as counted
+// by the server, without fetching them
+func (s *Server) SearchTotal(ctx context.Context, searchText, field string, filters SearchFilters) (int, error) {
+	filters.CalculateTotal = true
+	searchResult, err := s.searchPage(ctx, searchText, field, filters, 0)
+	if err != nil {
+		return 0, err
+	}
+	return searchResult.Total, nil
+}
+
+// searchPage gets the page of secret search results starting at skip
+func (s *Server) searchPage(ctx context.Context, searchText, field string, filters SearchFilters, skip int) (*SearchResult, error) {
+	l := s.log(ctx)
 
 	searchResult := new(SearchResult)
-	if data, err := s.searchResources(ctx, resource, searchText, field); err == nil {
+	if data, err := s.searchResources(ctx, resource, searchText, field, filters, skip); err == nil {
 		if err = json.Unmarshal(data, searchResult); err != nil {
 			l.Error("error parsing secret response", zap.String("search_text", searchText), zap.String("data", string(data)))
 			return nil, err
@@ -101,37 +872,121 @@ func (s *Server) Secrets(ctx context.Context, searchText, field string) ([]Secre
 		return nil, err
 	}
 
-	searchRecords := searchResult.Records
-	secrets := make([]Secret, len(searchRecords))
-	for i, record := range searchRecords {
-		//secrets returned in search results are not fully populated
-		secret, err := s.Secret(ctx, record.ID)
+	return searchResult, nil
+}
+
+// eachSecret pages through every result of the secret search, fetching each
+// matching secret in full and passing it to fn. Iteration stops at the first
+// error, from either the search or fn.
+func (s *Server) eachSecret(ctx context.Context, searchText, field string, filters SearchFilters, fn func(*Secret) error) error {
+	return eachPage(func(skip int) (resultPage, error) {
+		searchResult, err := s.searchPage(ctx, searchText, field, filters, skip)
 		if err != nil {
 			return nil, err
 		}
-		secrets[i] = *secret
+
+		for _, record := range searchResult.Records {
+			//secrets returned in search results are not fully populated
+			secret, err := s.Secret(ctx, record.ID)
+			if err != nil {
+				return nil, err
+			}
+			if err := fn(secret); err != nil {
+				return nil, err
+			}
+		}
+		return searchResult, nil
+	})
+}
+
+// ResolveConnectAs gets the secret referenced by the LauncherConnectAsSecretID
+// of the given secret, which the launcher connects as. It returns nil without
+// an error when the secret does not reference one.
+func (s *Server) ResolveConnectAs(ctx context.Context, secret *Secret) (*Secret, error) {
+	if secret == nil || secret.LauncherConnectAsSecretID == 0 {
+		return nil, nil
 	}
 
-	return secrets, nil
+	s.log(ctx).Debug("resolving the launcher connect as secret",
+		zap.Int("secret_id", secret.ID),
+		zap.Int("connect_as_secret_id", secret.LauncherConnectAsSecretID),
+	)
+	return s.Secret(ctx, secret.LauncherConnectAsSecretID)
 }
 
 func (s *Server) CreateSecret(ctx context.Context, secret Secret) (*Secret, error) {
-	return s.writeSecret(ctx, secret, http.MethodPost, "/")
+	if secret.FolderID == 0 {
+		secret.FolderID = s.defaultFolderID
+	}
+	if secret.SiteID == 0 {
+		secret.SiteID = s.defaultSiteID
+	}
+	if s.folderScopedCreate && secret.FolderID > 0 {
+		folderPath := path.Join(strconv.Itoa(secret.FolderID), resource)
+		return s.writeSecret(ctx, secret, http.MethodPost, folderResource, folderPath)
+	}
+	return s.writeSecret(ctx, secret, http.MethodPost, resource, "/")
+}
+
+// CopySecret creates a copy of the secret with sourceID named newName in the
+// folder with folderID, with the same field values and file attachments. The
+// copy is given new IDs by the server.
+func (s *Server) CopySecret(ctx context.Context, sourceID int, newName string, folderID int) (*Secret, error) {
+	source, err := s.Secret(ctx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments map[string][]byte
+	if s.skipFileDownload {
+		if attachments, err = s.ResolveAttachments(ctx, source); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := make([]SecretField, 0, len(source.Fields))
+	for _, field := range source.Fields {
+		if field.IsFile {
+			// file fields without an attachment are left out, rather than
+			// cleared on the new secret
+			if !s.isAttachment(field) {
+				continue
+			}
+			if contents, found := attachments[field.Slug]; found {
+				field.ItemValue = string(contents)
+			}
+		}
+		field.ItemID = 0
+		field.FileAttachmentID = 0
+		fields = append(fields, field)
+	}
+
+	secret := *source
+	secret.ID = 0
+	secret.Name = newName
+	secret.FolderID = folderID
+	secret.Fields = fields
+	secret.SshKeyArgs = nil
+
+	s.log(ctx).Debug("copying the secret", zap.Int("secret_id", sourceID), zap.String("secret_name", newName), zap.Int("folder_id", folderID))
+	return s.CreateSecret(ctx, secret)
 }
 
 func (s *Server) UpdateSecret(ctx context.Context, secret Secret) (*Secret, error) {
-	l := ctxzap.Extract(ctx)
+	l := s.log(ctx)
 
 	if secret.SshKeyArgs != nil && (secret.SshKeyArgs.GenerateSshKeys || secret.SshKeyArgs.GeneratePassphrase) {
 		l.Error("SSH key and passphrase generation is only supported during secret creation", zap.String("secret_name", secret.Name))
 		return nil, errors.New("SSH key and passphrase generation is only supported during secret creation")
 	}
 	secret.SshKeyArgs = nil
-	return s.writeSecret(ctx, secret, http.MethodPut, strconv.Itoa(secret.ID))
+	return s.writeSecret(ctx, secret, http.MethodPut, resource, strconv.Itoa(secret.ID))
 }
 
-func (s *Server) writeSecret(ctx context.Context, secret Secret, method string, secretPath string) (*Secret, error) {
-	l := ctxzap.Extract(ctx)
+// writeSecret writes the secret with the method to the path of the resource,
+// which is the secrets resource but for a folder-scoped create
+func (s *Server) writeSecret(ctx context.Context, secret Secret, method, writeResource, secretPath string) (*Secret, error) {
+	l := s.log(ctx)
 	writtenSecret := new(Secret)
 
 	template, err := s.SecretTemplate(ctx, secret.SecretTemplateID)
@@ -139,6 +994,17 @@ func (s *Server) writeSecret(ctx context.Context, secret Secret, method string,
 		return nil, err
 	}
 
+	// check locally that the template can receive the generated SSH key pair
+	// or passphrase, since the server rejects it with an opaque error
+	if err := template.validateSshKeyArgs(secret.SshKeyArgs); err != nil {
+		l.Error("error validating the SSH key arguments", zap.String("secret_name", secret.Name), zap.Error(err))
+		return nil, err
+	}
+
+	if s.autoPopulateSlugs {
+		secret.populateSlugs(ctx, template)
+	}
+
 	// If the user did not request SSH key generation, separate the
 	// secret's fields into file fields and general fields, since we
 	// need to take active control of either providing the files'
@@ -152,7 +1018,7 @@ func (s *Server) writeSecret(ctx context.Context, secret Secret, method string,
 	fileFields := make([]SecretField, 0)
 	generalFields := make([]SecretField, 0)
 	if secret.SshKeyArgs == nil || !secret.SshKeyArgs.GenerateSshKeys {
-		fileFields, generalFields, err = secret.separateFileFields(ctx, template)
+		fileFields, generalFields, err = secret.separateFileFields(s.logContext(ctx), template)
 		if err != nil {
 			return nil, err
 		}
@@ -177,7 +1043,19 @@ func (s *Server) writeSecret(ctx context.Context, secret Secret, method string,
 		secret.Fields = make([]SecretField, 0)
 	}
 
-	if data, err := s.accessResource(ctx, method, resource, secretPath, secret); err == nil {
+	// serialize the fields in a stable order, so that the same secret always
+	// makes the same request body
+	secret.Fields = sortedFields(secret.Fields)
+
+	var input interface{} = secret
+	if s.fieldNameMapper != nil {
+		if input, err = mapFieldNames(secret, s.fieldNameMapper); err != nil {
+			l.Error("error mapping the secret field names", zap.String("secret_name", secret.Name), zap.Error(err))
+			return nil, err
+		}
+	}
+
+	if data, err := s.accessResource(ctx, method, writeResource, secretPath, input); err == nil {
 		if err = json.Unmarshal(data, writtenSecret); err != nil {
 			l.Error("error parsing secret response", zap.String("secret_path", secretPath), zap.String("data", string(data)))
 			return nil, err
@@ -193,11 +1071,127 @@ func (s *Server) writeSecret(ctx context.Context, secret Secret, method string,
 	return s.Secret(ctx, writtenSecret.ID)
 }
 
+// MoveSecret moves the secret with secretID into the folder with
+// targetFolderID, verifying that the move took effect
+func (s *Server) MoveSecret(ctx context.Context, secretID, targetFolderID int) error {
+	l := s.log(ctx)
+
+	type folderMod struct {
+		Dirty bool
+		Value int
+	}
+
+	type generalMods struct {
+		Folder folderMod
+	}
+
+	type generalPatch struct {
+		Data generalMods
+	}
+
+	generalPath := path.Join(strconv.Itoa(secretID), "general")
+	input := generalPatch{Data: generalMods{Folder: folderMod{Dirty: true, Value: targetFolderID}}}
+	if _, err := s.accessResource(ctx, http.MethodPatch, resource, generalPath, input); err != nil {
+		return err
+	}
+
+	summary, err := s.SecretMetadata(ctx, secretID)
+	if err != nil {
+		return err
+	}
+	if summary.FolderID != targetFolderID {
+		l.Error("the secret was not moved", zap.Int("secret_id", secretID), zap.Int("folder_id", summary.FolderID), zap.Int("target_folder_id", targetFolderID))
+		return fmt.Errorf("[ERROR] secret '%d' is in folder '%d' rather than folder '%d' after the move", secretID, summary.FolderID, targetFolderID)
+	}
+
+	return nil
+}
+
+// mapFieldNames marshals the value to JSON, renaming every object key with the
+// mapper, at every level of nesting
+func mapFieldNames(value interface{}, mapper func(string) string) (json.RawMessage, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	var rename func(interface{}) interface{}
+	rename = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			renamed := make(map[string]interface{}, len(v))
+			for key, item := range v {
+				renamed[mapper(key)] = rename(item)
+			}
+			return renamed
+		case []interface{}:
+			for i, item := range v {
+				v[i] = rename(item)
+			}
+			return v
+		default:
+			return v
+		}
+	}
+
+	return json.Marshal(rename(decoded))
+}
+
+// DeleteResult is the confirmation of a deletion returned by Secret Server. It
+// does not say whether the deletion was soft or hard because the response of
+// Secret Server does not either: deleting a secret always deactivates it, a
+// soft deletion, and erasing it for good is a separate administrative task.
+type DeleteResult struct {
+	ID int
+	// ObjectType is the kind of object which was deleted, "Secret" for
+	// DeleteSecretResult
+	ObjectType string
+	// ResponseCodes are the codes of any warnings about the deletion
+	ResponseCodes []string
+}
+
+// DeleteSecret deletes the secret with id, discarding the confirmation without
+// parsing it; use DeleteSecretResult to get it
 func (s *Server) DeleteSecret(ctx context.Context, id int) error {
 	_, err := s.accessResource(ctx, http.MethodDelete, resource, strconv.Itoa(id), nil)
 	return err
 }
 
+// DeleteSecretResult deletes the secret with id and returns the confirmation
+// of the server. Secret Server deactivates the secret, which can still be read
+// with SecretIncludeInactive, rather than erasing it. A confirmation of another
+// ID is returned as is, with a warning logged, for the caller to verify.
+func (s *Server) DeleteSecretResult(ctx context.Context, id int) (*DeleteResult, error) {
+	l := s.log(ctx)
+
+	data, err := s.accessResource(ctx, http.MethodDelete, resource, strconv.Itoa(id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(DeleteResult)
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err = json.Unmarshal(data, result); err != nil {
+			l.Error("error parsing delete response", zap.Int("secret_id", id), zap.String("data", string(data)))
+			return nil, err
+		}
+	}
+	if result.ID == 0 {
+		result.ID = id
+	}
+	if result.ID != id {
+		l.Warn("the server confirmed the deletion of another secret", zap.Int("secret_id", id), zap.Int("deleted_id", result.ID))
+	}
+	return result, nil
+}
+
 // Field returns the value of the field with the name fieldName
 func (s *Secret) Field(ctx context.Context, fieldName string) (string, bool) {
 	l := ctxzap.Extract(ctx)
@@ -212,6 +1206,101 @@ func (s *Secret) Field(ctx context.Context, fieldName string) (string, bool) {
 	return "", false
 }
 
+// FieldByName returns the value of the field whose FieldName is name, ignoring
+// slugs, which Field would also match
+func (s *Secret) FieldByName(ctx context.Context, name string) (string, bool) {
+	l := ctxzap.Extract(ctx)
+	for _, field := range s.Fields {
+		if name == field.FieldName {
+			l.Debug("field with name matches", zap.String("field_name", field.FieldName))
+			return field.ItemValue, true
+		}
+	}
+
+	l.Debug("no field with matching name", zap.String("field_name", name), zap.String("secret_name", s.Name))
+	return "", false
+}
+
+// FieldBySlug returns the value of the field whose Slug is slug, ignoring field
+// names, which Field would also match
+func (s *Secret) FieldBySlug(ctx context.Context, slug string) (string, bool) {
+	l := ctxzap.Extract(ctx)
+	for _, field := range s.Fields {
+		if slug == field.Slug {
+			l.Debug("field with slug matches", zap.String("field_slug", field.Slug))
+			return field.ItemValue, true
+		}
+	}
+
+	l.Debug("no field with matching slug", zap.String("field_slug", slug), zap.String("secret_name", s.Name))
+	return "", false
+}
+
+// FieldTrimmed returns the value of the field with the name or slug fieldName,
+// like Field, with any leading and trailing whitespace, such as the trailing
+// newline of a pasted SSH key, removed. Whitespace within the value is kept.
+func (s *Secret) FieldTrimmed(ctx context.Context, fieldName string) (string, bool) {
+	value, found := s.Field(ctx, fieldName)
+	return strings.TrimSpace(value), found
+}
+
+// DefaultFieldValueDelimiter separates the values of a multi-select list field
+const DefaultFieldValueDelimiter = ","
+
+// FieldValues returns the values of the field with the name or slug fieldName,
+// such as the selections of a multi-select list field, split on
+// DefaultFieldValueDelimiter. Each value is trimmed of whitespace and empty
+// values are dropped, so a field without a value has none.
+func (s *Secret) FieldValues(ctx context.Context, fieldName string) ([]string, bool) {
+	return s.FieldValuesWithDelimiter(ctx, fieldName, DefaultFieldValueDelimiter)
+}
+
+// FieldValuesWithDelimiter returns the values of the field like FieldValues,
+// split on the given delimiter, for servers which separate them differently
+func (s *Secret) FieldValuesWithDelimiter(ctx context.Context, fieldName, delimiter string) ([]string, bool) {
+	value, found := s.Field(ctx, fieldName)
+	if !found {
+		return nil, false
+	}
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, delimiter) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, true
+}
+
+// SSHPrivateKey returns the private key of a secret whose SSH key pair was
+// generated by the server, which is downloaded with the secret unless
+// WithoutAutoFileDownload is set
+func (s *Secret) SSHPrivateKey(ctx context.Context) (string, bool) {
+	return s.FieldBySlug(ctx, FieldPrivateKey)
+}
+
+// SSHPublicKey returns the public key of a secret whose SSH key pair was
+// generated by the server
+func (s *Secret) SSHPublicKey(ctx context.Context) (string, bool) {
+	return s.FieldBySlug(ctx, FieldPublicKey)
+}
+
+// SSHPassphrase returns the private key passphrase of a secret whose
+// passphrase was generated by the server
+func (s *Secret) SSHPassphrase(ctx context.Context) (string, bool) {
+	return s.FieldBySlug(ctx, FieldPrivateKeyPassphrase)
+}
+
+// HasField reports whether the secret has a field with the name or slug
+// fieldName, without logging a miss like Field does
+func (s *Secret) HasField(fieldName string) bool {
+	for _, field := range s.Fields {
+		if fieldName == field.FieldName || fieldName == field.Slug {
+			return true
+		}
+	}
+	return false
+}
+
 // FieldById returns the value of the field with the given field ID
 func (s *Secret) FieldById(ctx context.Context, fieldId int) (string, bool) {
 	l := ctxzap.Extract(ctx)
@@ -226,35 +1315,115 @@ func (s *Secret) FieldById(ctx context.Context, fieldId int) (string, bool) {
 	return "", false
 }
 
-// updateFiles iterates the list of file fields and if the field's item value is empty,
-// deletes the file, otherwise, uploads the contents of the item value as the new/updated
-// file attachment.
-func (s *Server) updateFiles(ctx context.Context, secretId int, fileFields []SecretField) error {
-	type fieldMod struct {
-		Slug  string
-		Dirty bool
-		Value interface{}
+// sortedFields returns a copy of the fields ordered by FieldID and then by
+// slug, leaving the given slice untouched
+func sortedFields(fields []SecretField) []SecretField {
+	sorted := make([]SecretField, len(fields))
+	copy(sorted, fields)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].FieldID != sorted[j].FieldID {
+			return sorted[i].FieldID < sorted[j].FieldID
+		}
+		return sorted[i].Slug < sorted[j].Slug
+	})
+	return sorted
+}
+
+// fieldMod is a field update of a secret patch; only fields marked Dirty are
+// changed, and a nil Value clears the field
+type fieldMod struct {
+	Slug  string
+	Dirty bool
+	Value interface{}
+}
+
+type fieldMods struct {
+	SecretFields []fieldMod
+}
+
+type secretPatch struct {
+	Data fieldMods
+}
+
+// PatchFields updates the fields of the secret with the given ID which are
+// identified by the slugs of updates, in a single request, leaving its other
+// fields untouched. A nil value clears the field.
+func (s *Server) PatchFields(ctx context.Context, secretID int, updates map[string]interface{}) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	slugs := make([]string, 0, len(updates))
+	for slug := range updates {
+		slugs = append(slugs, slug)
 	}
+	sort.Strings(slugs)
 
-	type fieldMods struct {
-		SecretFields []fieldMod
+	mods := make([]fieldMod, 0, len(slugs))
+	for _, slug := range slugs {
+		mods = append(mods, fieldMod{Slug: slug, Dirty: true, Value: updates[slug]})
 	}
 
-	type secretPatch struct {
-		Data fieldMods
+	generalPath := path.Join(strconv.Itoa(secretID), "general")
+	_, err := s.accessResource(ctx, http.MethodPatch, resource, generalPath, secretPatch{Data: fieldMods{SecretFields: mods}})
+	return err
+}
+
+// UpdateSecretFields updates only the given fields of the secret with
+// secretID, leaving its other fields untouched, rather than writing the whole
+// secret like UpdateSecret. The text fields are marked dirty in a single
+// patch; the fields with IsFile set are uploaded, or deleted when their
+// ItemValue is empty. Fields with only a FieldID are resolved to their slug
+// from the template of the secret.
+func (s *Server) UpdateSecretFields(ctx context.Context, secretID int, fields []SecretField) error {
+	l := s.log(ctx)
+
+	var template *SecretTemplate
+	updates := make(map[string]interface{}, len(fields))
+	fileFields := make([]SecretField, 0)
+	for _, field := range fields {
+		if field.Slug == "" {
+			if template == nil {
+				summary, err := s.SecretMetadata(ctx, secretID)
+				if err != nil {
+					return err
+				}
+				if template, err = s.SecretTemplate(ctx, summary.SecretTemplateID); err != nil {
+					return err
+				}
+			}
+			slug, found := template.FieldIdToSlug(s.logContext(ctx), field.FieldID)
+			if !found {
+				l.Error("field id is not defined on the secret template", zap.Int("field_id", field.FieldID), zap.Int("template_id", template.ID))
+				return fmt.Errorf("[ERROR] field id '%d' is not defined on the secret template with id '%d'", field.FieldID, template.ID)
+			}
+			field.Slug = slug
+		}
+
+		if field.IsFile {
+			fileFields = append(fileFields, field)
+		} else {
+			updates[field.Slug] = field.ItemValue
+		}
 	}
 
+	if err := s.PatchFields(ctx, secretID, updates); err != nil {
+		return err
+	}
+	return s.updateFiles(ctx, secretID, fileFields)
+}
+
+// updateFiles iterates the list of file fields and if the field's item value is empty,
+// deletes the file, otherwise, uploads the contents of the item value as the new/updated
+// file attachment.
+func (s *Server) updateFiles(ctx context.Context, secretId int, fileFields []SecretField) error {
 	for _, element := range fileFields {
-		var elementPath string
-		var input interface{}
 		if element.ItemValue == "" {
-			elementPath = path.Join(strconv.Itoa(secretId), "general")
-			input = secretPatch{Data: fieldMods{SecretFields: []fieldMod{{Slug: element.Slug, Dirty: true, Value: nil}}}}
-			if _, err := s.accessResource(ctx, http.MethodPatch, resource, elementPath, input); err != nil {
+			if err := s.PatchFields(ctx, secretId, map[string]interface{}{element.Slug: nil}); err != nil {
 				return err
 			}
 		} else {
-			if err := s.uploadFile(ctx, secretId, element); err != nil {
+			if err := s.uploadFile(ctx, secretId, element, ""); err != nil {
 				return err
 			}
 		}
@@ -262,6 +1431,159 @@ func (s *Server) updateFiles(ctx context.Context, secretId int, fileFields []Sec
 	return nil
 }
 
+// UploadFile uploads the contents of the file field, identified by its Slug,
+// to the secret with secretID under the given filename, regardless of the
+// Filename of the field, for when the name of the local file differs from the
+// one the server should keep. An empty filename is derived from the field's
+// Filename, as when the secret is written.
+func (s *Server) UploadFile(ctx context.Context, secretID int, fileField SecretField, filename string) error {
+	if fileField.Slug == "" {
+		return errors.New("[ERROR] the file field to upload requires a slug")
+	}
+	return s.uploadFile(ctx, secretID, fileField, filename)
+}
+
+// EqualIgnoringServerFields reports whether the secret and other agree on the
+// fields a caller controls: the name, template, folder and site, and the value
+// of each field by slug, or by FieldID for a field without a slug.
+// Server-assigned IDs, such as ItemID and FileAttachmentID, and computed flags
+// are ignored.
+func (s *Secret) EqualIgnoringServerFields(other *Secret) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	if s.Name != other.Name || s.SecretTemplateID != other.SecretTemplateID ||
+		s.FolderID != other.FolderID || s.SiteID != other.SiteID {
+		return false
+	}
+	if len(s.Fields) != len(other.Fields) {
+		return false
+	}
+
+	bySlug := make(map[string]int, len(s.Fields))
+	byID := make(map[int]int, len(s.Fields))
+	for i, field := range s.Fields {
+		if field.Slug != "" {
+			bySlug[field.Slug] = i
+		}
+		if field.FieldID != 0 {
+			byID[field.FieldID] = i
+		}
+	}
+
+	// each field of s matches at most one field of other
+	matched := make([]bool, len(s.Fields))
+	for _, field := range other.Fields {
+		i, found := bySlug[field.Slug]
+		if !found || field.Slug == "" {
+			i, found = byID[field.FieldID]
+			found = found && field.FieldID != 0 && (field.Slug == "" || s.Fields[i].Slug == "")
+		}
+		if !found || matched[i] || s.Fields[i].ItemValue != field.ItemValue {
+			return false
+		}
+		matched[i] = true
+	}
+	return true
+}
+
+// redactedValue replaces the values of redacted fields
+const redactedValue = "********"
+
+// Redacted returns a copy of the secret with the values of its password fields
+// replaced, so that the copy can be stored or displayed safely
+func (s Secret) Redacted() Secret {
+	fields := make([]SecretField, len(s.Fields))
+	for i, field := range s.Fields {
+		if field.IsPassword && field.ItemValue != "" {
+			field.ItemValue = redactedValue
+		}
+		fields[i] = field
+	}
+	s.Fields = fields
+	return s
+}
+
+// FileFields returns the fields of the secret which hold file attachments,
+// without downloading their contents
+func (s *Secret) FileFields() []SecretField {
+	var fileFields []SecretField
+	for _, field := range s.Fields {
+		if field.IsFile {
+			fileFields = append(fileFields, field)
+		}
+	}
+	return fileFields
+}
+
+// EnrichFields merges the metadata of the template of the secret into its
+// fields, matched by FieldID or else by slug: the description and name where
+// the field has none, and whether the field is required. Fields which are not
+// on the template are left alone.
+func (s *Server) EnrichFields(ctx context.Context, secret *Secret) error {
+	if secret == nil {
+		return errors.New("a secret is required to enrich its fields")
+	}
+
+	template, err := s.SecretTemplate(ctx, secret.SecretTemplateID)
+	if err != nil {
+		return err
+	}
+	secret.mergeTemplateFields(s.logContext(ctx), template)
+	return nil
+}
+
+// mergeTemplateFields merges the metadata of the matching template field into
+// each field of the secret, for EnrichFields
+func (s *Secret) mergeTemplateFields(ctx context.Context, template *SecretTemplate) {
+	l := ctxzap.Extract(ctx)
+
+	byID := make(map[int]SecretTemplateField, len(template.Fields))
+	bySlug := make(map[string]SecretTemplateField, len(template.Fields))
+	for _, field := range template.Fields {
+		byID[field.SecretTemplateFieldID] = field
+		bySlug[field.FieldSlugName] = field
+	}
+
+	for i, field := range s.Fields {
+		templateField, found := byID[field.FieldID]
+		if !found || field.FieldID == 0 {
+			if templateField, found = bySlug[field.Slug]; !found {
+				l.Debug("the field is not on the template", zap.Int("field_id", field.FieldID), zap.String("slug", field.Slug), zap.Int("template_id", template.ID))
+				continue
+			}
+		}
+
+		if field.FieldDescription == "" {
+			field.FieldDescription = templateField.Description
+		}
+		if field.FieldName == "" {
+			field.FieldName = templateField.DisplayName
+		}
+		if field.Slug == "" {
+			field.Slug = templateField.FieldSlugName
+		}
+		field.IsRequired = templateField.IsRequired
+		s.Fields[i] = field
+	}
+}
+
+// populateSlugs sets the Slug of each field which only has its FieldID, from
+// the matching field of the template. Fields whose ID is not on the template
+// are left alone, for separateFileFields to report.
+func (s *Secret) populateSlugs(ctx context.Context, template *SecretTemplate) {
+	fields := make([]SecretField, len(s.Fields))
+	for i, field := range s.Fields {
+		if field.Slug == "" && field.FieldID != 0 {
+			if slug, found := template.FieldIdToSlug(ctx, field.FieldID); found {
+				field.Slug = slug
+			}
+		}
+		fields[i] = field
+	}
+	s.Fields = fields
+}
+
 // separateFileFields iterates the fields on this secret, and separates them into file
 // fields and non-file fields, using the field definitions in the given template as a
 // guide. File fields are returned as the first output, non file fields as the second
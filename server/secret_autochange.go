@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// autoChangeSchedulePath is the path, under a secret, of its auto-change
+// schedule
+const autoChangeSchedulePath = "auto-change-schedule"
+
+// AutoChangeSchedule is when Secret Server automatically changes the password
+// of a secret
+type AutoChangeSchedule struct {
+	AutoChangeEnabled bool
+	// ChangeIntervalDays is the number of days between automatic changes
+	ChangeIntervalDays int
+	// NextChangeDate is when the next automatic change is due, as returned by
+	// the server; it is left out when the schedule is set
+	NextChangeDate string `json:",omitempty"`
+}
+
+// NextChange parses the NextChangeDate of the schedule, returning the zero
+// time when no change is due
+func (a AutoChangeSchedule) NextChange() (time.Time, error) {
+	if a.NextChangeDate == "" {
+		return time.Time{}, nil
+	}
+	return parseServerTime(a.NextChangeDate)
+}
+
+// AutoChangeSchedule gets the auto-change schedule of the secret with secretID
+func (s *Server) AutoChangeSchedule(ctx context.Context, secretID int) (*AutoChangeSchedule, error) {
+	return s.accessAutoChangeSchedule(ctx, http.MethodGet, secretID, nil)
+}
+
+// SetAutoChangeSchedule sets the auto-change schedule of the secret with
+// secretID, returning the schedule as updated by the server, with the date of
+// its next change
+func (s *Server) SetAutoChangeSchedule(ctx context.Context, secretID int, schedule AutoChangeSchedule) (*AutoChangeSchedule, error) {
+	if schedule.ChangeIntervalDays < 0 || schedule.AutoChangeEnabled && schedule.ChangeIntervalDays == 0 {
+		return nil, errors.New("[ERROR] an enabled auto-change schedule requires a positive interval")
+	}
+	schedule.NextChangeDate = ""
+	return s.accessAutoChangeSchedule(ctx, http.MethodPut, secretID, schedule)
+}
+
+// accessAutoChangeSchedule sends the request for the auto-change schedule of
+// the secret with secretID and parses the schedule it returns
+func (s *Server) accessAutoChangeSchedule(ctx context.Context, method string, secretID int, input interface{}) (*AutoChangeSchedule, error) {
+	l := s.log(ctx)
+	schedule := new(AutoChangeSchedule)
+
+	schedulePath := path.Join(strconv.Itoa(secretID), autoChangeSchedulePath)
+	if data, err := s.accessResource(ctx, method, resource, schedulePath, input); err == nil {
+		if err = json.Unmarshal(data, schedule); err != nil {
+			l.Error("error parsing auto-change schedule response", zap.Int("secret_id", secretID), zap.String("data", string(data)))
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return schedule, nil
+}
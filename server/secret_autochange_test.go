@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestAutoChangeSchedule asserts that AutoChangeSchedule parses the schedule
+// of a secret, with the date of its next change, and that
+// SetAutoChangeSchedule sends the updated interval.
+func TestAutoChangeSchedule(t *testing.T) {
+	ctx := context.Background()
+	var updated map[string]interface{}
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/secrets/1/auto-change-schedule" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`{"autoChangeEnabled": true, "changeIntervalDays": 30, "nextChangeDate": "2026-11-01T04:00:00Z"}`))
+		case http.MethodPut:
+			if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"autoChangeEnabled": true, "changeIntervalDays": 7, "nextChangeDate": "2026-10-08T04:00:00"}`))
+		}
+	}))
+
+	schedule, err := tss.AutoChangeSchedule(ctx, 1)
+	if err != nil {
+		t.Fatal("calling server.AutoChangeSchedule:", err)
+	}
+	validate("enabled", true, schedule.AutoChangeEnabled, t)
+	validate("interval", 30, schedule.ChangeIntervalDays, t)
+	next, err := schedule.NextChange()
+	if err != nil {
+		t.Fatal("parsing the next change:", err)
+	}
+	validate("next change", time.Date(2026, time.November, 1, 4, 0, 0, 0, time.UTC), next, t)
+
+	schedule.ChangeIntervalDays = 7
+	schedule, err = tss.SetAutoChangeSchedule(ctx, 1, *schedule)
+	if err != nil {
+		t.Fatal("calling server.SetAutoChangeSchedule:", err)
+	}
+	validate("sent interval", float64(7), updated["ChangeIntervalDays"], t)
+	if next, found := updated["NextChangeDate"]; found {
+		t.Errorf("expected no next change to be sent, but found '%v'", next)
+	}
+	validate("updated interval", 7, schedule.ChangeIntervalDays, t)
+	if next, err := schedule.NextChange(); err != nil || next.Day() != 8 {
+		t.Errorf("expected the updated next change to parse, but found %s (%v)", next, err)
+	}
+
+	if _, err := tss.SetAutoChangeSchedule(ctx, 1, AutoChangeSchedule{AutoChangeEnabled: true}); err == nil {
+		t.Error("expected an error for an enabled schedule without an interval")
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+// ExportOption configures ExportSecrets
+type ExportOption func(export *exportConfig)
+
+type exportConfig struct {
+	redactPasswords bool
+}
+
+// WithPasswordRedaction redacts the values of password fields in the export
+func WithPasswordRedaction() ExportOption {
+	return func(export *exportConfig) {
+		export.redactPasswords = true
+	}
+}
+
+// ExportSecrets writes every secret matching the search to w as newline
+// delimited JSON, one secret per line, paging through all of the results. It
+// returns the number of secrets written, which is accurate even on error.
+func (s *Server) ExportSecrets(ctx context.Context, searchText, field string, w io.Writer, opts ...ExportOption) (int, error) {
+	l := s.log(ctx)
+
+	export := &exportConfig{}
+	for _, opt := range opts {
+		opt(export)
+	}
+
+	count := 0
+	encoder := json.NewEncoder(w)
+	err := s.eachSecret(ctx, searchText, field, SearchFilters{}, func(secret *Secret) error {
+		record := *secret
+		if export.redactPasswords {
+			record = record.Redacted()
+		}
+		if err := encoder.Encode(record); err != nil {
+			l.Error("error writing exported secret", zap.Int("secret_id", secret.ID), zap.Error(err))
+			return err
+		}
+		count++
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestExportSecrets asserts that ExportSecrets pages through a multi-result
+// search and writes one valid JSON secret per line, redacting passwords when
+// requested.
+func TestExportSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/secrets":
+			if r.URL.Query().Get("paging.skip") == "0" {
+				w.Write([]byte(`{"skip": 0, "nextSkip": 2, "hasNext": true, "records": [{"id": 1}, {"id": 2}]}`))
+			} else {
+				w.Write([]byte(`{"skip": 2, "nextSkip": 3, "hasNext": false, "records": [{"id": 3}]}`))
+			}
+		default:
+			id := strings.TrimPrefix(r.URL.Path, "/api/v1/secrets/")
+			fmt.Fprintf(w, `{"id": %s, "name": "Secret %s", "items": [
+				{"slug": "username", "itemValue": "user%s"},
+				{"slug": "password", "itemValue": "Passw0rd.", "isPassword": true}
+			]}`, id, id, id)
+		}
+	}))
+
+	for _, redact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Redact=%t", redact), func(t *testing.T) {
+			var opts []ExportOption
+			expectedPassword := "Passw0rd."
+			if redact {
+				opts = append(opts, WithPasswordRedaction())
+				expectedPassword = redactedValue
+			}
+
+			buf := &bytes.Buffer{}
+			count, err := tss.ExportSecrets(ctx, "Secret", "", buf, opts...)
+			if err != nil {
+				t.Fatal("calling server.ExportSecrets:", err)
+			}
+			validate("export count", 3, count, t)
+
+			lines := 0
+			scanner := bufio.NewScanner(buf)
+			for scanner.Scan() {
+				lines++
+				secret := new(Secret)
+				if err := json.Unmarshal(scanner.Bytes(), secret); err != nil {
+					t.Fatalf("line %d is not valid JSON: %s", lines, err)
+				}
+				validate("secret id", lines, secret.ID, t)
+				password, _ := secret.Field(ctx, "password")
+				validate("password", expectedPassword, password, t)
+				username, _ := secret.Field(ctx, "username")
+				validate("username", fmt.Sprintf("user%d", lines), username, t)
+			}
+			validate("line count", 3, lines, t)
+		})
+	}
+}
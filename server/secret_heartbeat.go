@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// ErrVerificationUnsupported is returned by VerifyField for a field which the
+// heartbeat of Secret Server cannot verify against the target system
+var ErrVerificationUnsupported = errors.New("the field cannot be verified against the target system")
+
+// The heartbeat statuses of Secret Server which VerifyField interprets
+const (
+	HeartbeatSuccess    = "Success"
+	HeartbeatFailed     = "Failed"
+	HeartbeatPending    = "Pending"
+	HeartbeatProcessing = "Processing"
+)
+
+// FieldVerification is the outcome of verifying a secret field against the
+// target system with VerifyField
+type FieldVerification struct {
+	SecretID int
+	Slug     string
+	// Status is the heartbeat status reported by Secret Server, such as
+	// Success, Failed, UnableToConnect or AccountLockedOut
+	Status string
+}
+
+// Verified reports whether the target system accepted the value of the field
+func (v FieldVerification) Verified() bool {
+	return v.Status == HeartbeatSuccess
+}
+
+// Pending reports whether the verification has not finished yet, in which case
+// VerifyField can be called again later
+func (v FieldVerification) Pending() bool {
+	return v.Status == HeartbeatPending || v.Status == HeartbeatProcessing
+}
+
+// heartbeatResult is the response of Secret Server to running the heartbeat
+// of a secret
+type heartbeatResult struct {
+	HeartbeatStatus string
+}
+
+// VerifyField runs the heartbeat of the secret with secretID to check the value
+// of the field with the given slug against the target system, without changing
+// it, for pre-deployment checks. Only password fields can be verified; other
+// fields return an error matching ErrVerificationUnsupported. A failed
+// verification is not an error: it is reported by the Status of the result.
+func (s *Server) VerifyField(ctx context.Context, secretID int, slug string) (*FieldVerification, error) {
+	l := s.log(ctx)
+
+	summary, err := s.SecretMetadata(ctx, secretID)
+	if err != nil {
+		return nil, err
+	}
+	template, err := s.SecretTemplate(ctx, summary.SecretTemplateID)
+	if err != nil {
+		return nil, err
+	}
+	field, found := template.GetField(s.logContext(ctx), slug)
+	if !found {
+		return nil, fmt.Errorf("[ERROR] the alias '%s' does not identify a field on the template named '%s'", slug, template.Name)
+	}
+	if !field.IsPassword {
+		return nil, fmt.Errorf("%w: the field '%s' on the template named '%s' is not a password", ErrVerificationUnsupported, slug, template.Name)
+	}
+
+	heartbeatPath := path.Join(strconv.Itoa(secretID), "heartbeat")
+	data, err := s.accessResource(ctx, http.MethodPost, resource, heartbeatPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(heartbeatResult)
+	if err := json.Unmarshal(data, result); err != nil {
+		l.Error("error parsing heartbeat response", zap.Int("secret_id", secretID), zap.String("data", string(data)))
+		return nil, err
+	}
+	verification := &FieldVerification{SecretID: secretID, Slug: slug, Status: result.HeartbeatStatus}
+
+	l.Debug("verified secret field", zap.Int("secret_id", secretID), zap.String("slug", slug), zap.String("status", verification.Status))
+	return verification, nil
+}
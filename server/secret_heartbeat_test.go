@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// TestVerifyField asserts that VerifyField maps the heartbeat responses to the
+// status of the result, and refuses fields which are not passwords.
+func TestVerifyField(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   string
+		verified bool
+		pending  bool
+	}{
+		{"Success", `{"heartbeatStatus": "Success"}`, HeartbeatSuccess, true, false},
+		{"Failed", `{"heartbeatStatus": "Failed"}`, HeartbeatFailed, false, false},
+		{"AccountLockedOut", `{"heartbeatStatus": "AccountLockedOut"}`, "AccountLockedOut", false, false},
+		{"Pending", `{"heartbeatStatus": "Pending"}`, HeartbeatPending, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var heartbeats int
+			tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/api/v1/secrets/1/summary":
+					w.Write([]byte(`{"id": 1, "name": "Test Secret", "secretTemplateId": 6}`))
+				case r.URL.Path == "/api/v1/secret-templates/6":
+					w.Write([]byte(testTemplateJSON))
+				case r.Method == http.MethodPost && r.URL.Path == "/api/v1/secrets/1/heartbeat":
+					heartbeats++
+					w.Write([]byte(tt.body))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			ctx := context.Background()
+
+			verification, err := tss.VerifyField(ctx, 1, "password")
+			if err != nil {
+				t.Fatal("calling server.VerifyField:", err)
+			}
+			validate("status", tt.status, verification.Status, t)
+			validate("verified", tt.verified, verification.Verified(), t)
+			validate("pending", tt.pending, verification.Pending(), t)
+			validate("slug", "password", verification.Slug, t)
+
+			if _, err := tss.VerifyField(ctx, 1, "username"); !errors.Is(err, ErrVerificationUnsupported) {
+				t.Errorf("expected ErrVerificationUnsupported for a field which is not a password, but got '%v'", err)
+			}
+			validate("heartbeats", 1, heartbeats, t)
+		})
+	}
+}
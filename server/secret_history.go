@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serverTimeLayouts are the layouts of the timestamps returned by the server,
+// which omit the time zone on some versions
+var serverTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"}
+
+// FieldHistoryEntry is a value that a secret field was set to and when
+type FieldHistoryEntry struct {
+	ItemValue, UserName, Date string
+	UserID                    int
+}
+
+// defaultHistoryPageSize is the number of field history entries requested per
+// page
+const defaultHistoryPageSize = 100
+
+// fieldHistoryResult is a page of the history of a secret field
+type fieldHistoryResult struct {
+	NextSkip int
+	HasNext  bool
+	Records  []FieldHistoryEntry
+}
+
+func (p *fieldHistoryResult) paging() (int, bool, int) {
+	return p.NextSkip, p.HasNext, len(p.Records)
+}
+
+// SecretFieldHistory gets the history of the field with the given slug on the
+// secret with id, in the order returned by the server, paging through all of
+// it
+func (s *Server) SecretFieldHistory(ctx context.Context, id int, slug string) ([]FieldHistoryEntry, error) {
+	l := s.log(ctx)
+
+	entries := make([]FieldHistoryEntry, 0)
+	historyPath := path.Join(strconv.Itoa(id), "fields", slug, "history")
+	err := eachPage(func(skip int) (resultPage, error) {
+		query := url.Values{
+			"skip": {strconv.Itoa(skip)},
+			"take": {strconv.Itoa(defaultHistoryPageSize)},
+		}
+		data, err := s.accessResource(ctx, http.MethodGet, resource, withQuery(historyPath, query), nil)
+		if err != nil {
+			return nil, err
+		}
+		page := new(fieldHistoryResult)
+		if err = json.Unmarshal(data, page); err != nil {
+			l.Error("error parsing field history response", zap.Int("secret_id", id), zap.String("slug", slug), zap.String("data", string(data)))
+			return nil, err
+		}
+		entries = append(entries, page.Records...)
+		return page, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// versionWindow is how far apart the field changes of one save of a secret
+// can be recorded, since the server dates the history of each field on its own
+const versionWindow = time.Second
+
+// SecretAtVersion gets the secret with id as it was at the given version,
+// where version 1 is the secret as first created and every later save which
+// changed any of its fields is a new version.
+//
+// Secret Server only keeps the history of individual fields, so the version is
+// assembled by replaying the field histories in date order onto the current
+// secret. The changes recorded within versionWindow of the first change of a
+// version are taken to be the same save. File fields have no history and keep
+// their current contents.
+func (s *Server) SecretAtVersion(ctx context.Context, id int, version int) (*Secret, error) {
+	l := s.log(ctx)
+
+	secret, err := s.Secret(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	type change struct {
+		index int
+		date  time.Time
+		value string
+	}
+
+	var changes []change
+	for index, field := range secret.Fields {
+		if field.IsFile {
+			continue
+		}
+		history, err := s.SecretFieldHistory(ctx, id, field.Slug)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range history {
+			date, err := parseServerTime(entry.Date)
+			if err != nil {
+				l.Error("error parsing field history date", zap.String("slug", field.Slug), zap.String("date", entry.Date))
+				return nil, err
+			}
+			changes = append(changes, change{index: index, date: date, value: entry.ItemValue})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].date.Before(changes[j].date)
+	})
+
+	// versionEnds holds, for each version, the number of changes up to and
+	// including it
+	var versionEnds []int
+	var versionStart time.Time
+	for i, c := range changes {
+		if i == 0 || c.date.Sub(versionStart) > versionWindow {
+			versionStart = c.date
+			versionEnds = append(versionEnds, i+1)
+		} else {
+			versionEnds[len(versionEnds)-1] = i + 1
+		}
+	}
+
+	if version < 1 || version > len(versionEnds) {
+		return nil, fmt.Errorf("[ERROR] secret '%d' has versions 1 to %d, version '%d' does not exist", id, len(versionEnds), version)
+	}
+
+	// fields which had not been set yet at the version are empty
+	for index, field := range secret.Fields {
+		if !field.IsFile {
+			secret.Fields[index].ItemValue = ""
+		}
+	}
+	for _, c := range changes[:versionEnds[version-1]] {
+		secret.Fields[c.index].ItemValue = c.value
+	}
+
+	return secret, nil
+}
+
+// parseServerTime parses a timestamp returned by the server
+func parseServerTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range serverTimeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// AccessEntry is an entry of the audit trail of a secret, such as a view of
+// the secret along with the comment that was given for it
+type AccessEntry struct {
+	SecretAuditID, UserID                       int
+	Action, Notes, ByUserDisplayName, IPAddress string
+	MachineName, DateRecorded                   string
+}
+
+// accessHistoryResult is a page of the audit trail of a secret
+type accessHistoryResult struct {
+	Records []AccessEntry
+}
+
+// SecretAccessHistory gets the audit trail of the secret with id, most recent
+// first, including the comments given when accessing it
+func (s *Server) SecretAccessHistory(ctx context.Context, secretID int) ([]AccessEntry, error) {
+	l := s.log(ctx)
+	history := new(accessHistoryResult)
+
+	auditPath := path.Join(strconv.Itoa(secretID), "audits")
+	if data, err := s.accessResource(ctx, http.MethodGet, resource, auditPath, nil); err == nil {
+		if err = json.Unmarshal(data, history); err != nil {
+			l.Error("error parsing secret audit response", zap.Int("secret_id", secretID), zap.String("data", string(data)))
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return history.Records, nil
+}
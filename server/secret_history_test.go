@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// TestSecretAtVersion asserts that SecretAtVersion reconstructs prior versions
+// of a secret by replaying its field histories in date order, taking the
+// fields set at creation to be the first version, and that the field history
+// is paged through.
+func TestSecretAtVersion(t *testing.T) {
+	ctx := context.Background()
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/secrets/1":
+			w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": [
+				{"slug": "username", "itemValue": "admin2"},
+				{"slug": "password", "itemValue": "third", "isPassword": true}
+			]}`))
+		case "/api/v1/secrets/1/fields/username/history":
+			w.Write([]byte(`{"records": [
+				{"itemValue": "admin2", "date": "2024-03-01T00:00:00Z"},
+				{"itemValue": "admin", "date": "2024-01-01T00:00:00Z"}
+			]}`))
+		case "/api/v1/secrets/1/fields/password/history":
+			if r.URL.Query().Get("skip") == "2" {
+				w.Write([]byte(`{"hasNext": false, "records": [
+					{"itemValue": "third", "date": "2024-04-01T00:00:00"}
+				]}`))
+				return
+			}
+			w.Write([]byte(`{"hasNext": true, "nextSkip": 2, "records": [
+				{"itemValue": "first", "date": "2024-01-01T00:00:00.250"},
+				{"itemValue": "second", "date": "2024-02-01T00:00:00"}
+			]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	expected := []struct{ username, password string }{
+		{"admin", "first"},
+		{"admin", "second"},
+		{"admin2", "second"},
+		{"admin2", "third"},
+	}
+	for i, e := range expected {
+		secret, err := tss.SecretAtVersion(ctx, 1, i+1)
+		if err != nil {
+			t.Fatalf("calling server.SecretAtVersion for version %d: %s", i+1, err)
+		}
+		username, _ := secret.Field(ctx, "username")
+		password, _ := secret.Field(ctx, "password")
+		validate("username", e.username, username, t)
+		validate("password", e.password, password, t)
+	}
+
+	if _, err := tss.SecretAtVersion(ctx, 1, len(expected)+1); err == nil {
+		t.Error("expected an error for a version which does not exist")
+	}
+}
+
+// TestSecretAccessHistory asserts that SecretAccessHistory parses the audit
+// trail of a secret, with the comments given on access.
+func TestSecretAccessHistory(t *testing.T) {
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/secrets/1/audits" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"records": [
+			{"secretAuditId": 12, "action": "VIEW", "notes": "investigating incident 42", "byUserDisplayName": "Test User", "userId": 3, "ipAddress": "10.0.0.1", "machineName": "ws-1", "dateRecorded": "2024-03-02T10:00:00Z"},
+			{"secretAuditId": 11, "action": "EDIT", "notes": "", "byUserDisplayName": "Admin", "userId": 1, "dateRecorded": "2024-03-01T09:00:00Z"}
+		]}`))
+	}))
+
+	entries, err := tss.SecretAccessHistory(context.Background(), 1)
+	if err != nil {
+		t.Fatal("calling server.SecretAccessHistory:", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, but found %d", len(entries))
+	}
+	validate("audit id", 12, entries[0].SecretAuditID, t)
+	validate("action", "VIEW", entries[0].Action, t)
+	validate("comment", "investigating incident 42", entries[0].Notes, t)
+	validate("user", "Test User", entries[0].ByUserDisplayName, t)
+	validate("ip address", "10.0.0.1", entries[0].IPAddress, t)
+	validate("second action", "EDIT", entries[1].Action, t)
+}
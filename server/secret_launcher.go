@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// Launcher is a launcher configured on a secret, such as a Remote Desktop or
+// SSH launcher, which opens a session to the target with the credentials of
+// the secret
+type Launcher struct {
+	ID, LauncherTypeID int
+	// Name is the name of the launcher as shown to the user
+	Name string
+	// LauncherType is the kind of launcher, such as "Remote Desktop" or "PuTTY"
+	LauncherType string
+}
+
+// SecretLaunchers gets the launchers configured on the secret with secretID,
+// for building a "connect" UI; a secret without launchers has none
+func (s *Server) SecretLaunchers(ctx context.Context, secretID int) ([]Launcher, error) {
+	l := s.log(ctx)
+
+	launchersPath := path.Join(strconv.Itoa(secretID), "launchers")
+	data, err := s.accessResource(ctx, http.MethodGet, resource, launchersPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	launchers := make([]Launcher, 0)
+	if err := json.Unmarshal(data, &launchers); err != nil {
+		l.Error("error parsing secret launchers response", zap.Int("secret_id", secretID), zap.String("data", string(data)))
+		return nil, err
+	}
+
+	return launchers, nil
+}
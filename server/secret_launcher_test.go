@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// TestSecretLaunchers asserts that SecretLaunchers parses the launchers of a
+// secret.
+func TestSecretLaunchers(t *testing.T) {
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/secrets/1/launchers":
+			w.Write([]byte(`[
+				{"id": 1, "launcherTypeId": 1, "name": "Remote Desktop", "launcherType": "Remote Desktop"},
+				{"id": 2, "launcherTypeId": 6, "name": "SSH", "launcherType": "PuTTY"}
+			]`))
+		case "/api/v1/secrets/3/launchers":
+			w.Write([]byte(`[]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ctx := context.Background()
+
+	launchers, err := tss.SecretLaunchers(ctx, 1)
+	if err != nil {
+		t.Fatal("calling server.SecretLaunchers:", err)
+	}
+	if len(launchers) != 2 {
+		t.Fatalf("expected 2 launchers, but found %d", len(launchers))
+	}
+	validate("launcher name", "Remote Desktop", launchers[0].Name, t)
+	validate("launcher type", "PuTTY", launchers[1].LauncherType, t)
+	validate("launcher type id", 6, launchers[1].LauncherTypeID, t)
+
+	launchers, err = tss.SecretLaunchers(ctx, 3)
+	if err != nil {
+		t.Fatal("calling server.SecretLaunchers:", err)
+	}
+	validate("launchers of a secret without any", 0, len(launchers), t)
+}
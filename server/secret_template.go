@@ -3,9 +3,14 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/jirwin/ctxzap"
 	"go.uber.org/zap"
@@ -28,9 +33,106 @@ type SecretTemplateField struct {
 	IsFile, IsList, IsNotes, IsPassword, IsRequired, IsUrl  bool
 }
 
+// SlugCollisionError is returned when more than one field of a secret template
+// has the same slug, which would make GetField and FieldSlugToId ambiguous
+type SlugCollisionError struct {
+	TemplateName string
+	Slugs        []string
+}
+
+func (e *SlugCollisionError) Error() string {
+	return fmt.Sprintf("secret template '%s' has more than one field with the slug(s): %s", e.TemplateName, strings.Join(e.Slugs, ", "))
+}
+
+// ValidateFieldSlugs checks that no two fields of the template share a slug,
+// returning a *SlugCollisionError listing the colliding slugs otherwise.
+// Fields without a slug are not compared. No method of the Server calls it; it
+// is for callers to check a template before relying on GetField and
+// FieldSlugToId to find its fields.
+func (s SecretTemplate) ValidateFieldSlugs() error {
+	counts := make(map[string]int, len(s.Fields))
+	var collisions []string
+	for _, field := range s.Fields {
+		if field.FieldSlugName == "" {
+			continue
+		}
+		counts[field.FieldSlugName]++
+		if counts[field.FieldSlugName] == 2 {
+			collisions = append(collisions, field.FieldSlugName)
+		}
+	}
+	if len(collisions) > 0 {
+		return &SlugCollisionError{TemplateName: s.Name, Slugs: collisions}
+	}
+	return nil
+}
+
+// ErrSshGenerationUnsupported is matched (with errors.Is) by an
+// SshGenerationError
+var ErrSshGenerationUnsupported = errors.New("the secret template does not support SSH key generation")
+
+// SshGenerationError is returned when SshKeyArgs requests the generation of an
+// SSH key pair or passphrase for a secret whose template lacks the fields
+// which would receive them
+type SshGenerationError struct {
+	TemplateID   int
+	TemplateName string
+	// Missing describes the fields the template would need
+	Missing []string
+}
+
+func (e *SshGenerationError) Error() string {
+	return fmt.Sprintf("secret template %d ('%s') does not support the requested SSH generation: it has no %s",
+		e.TemplateID, e.TemplateName, strings.Join(e.Missing, ", "))
+}
+
+// Is allows errors.Is to match the SshGenerationError against
+// ErrSshGenerationUnsupported
+func (e *SshGenerationError) Is(target error) bool {
+	return target == ErrSshGenerationUnsupported
+}
+
+// validateSshKeyArgs checks that the template has the fields which SSH key
+// generation populates: the public-key and private-key fields for the key
+// pair, and the private-key-passphrase field for the passphrase
+func (s SecretTemplate) validateSshKeyArgs(args *SshKeyArgs) error {
+	if args == nil || !args.GenerateSshKeys && !args.GeneratePassphrase {
+		return nil
+	}
+	var publicKey, privateKey, passphrase bool
+	for _, field := range s.Fields {
+		switch strings.ToLower(field.FieldSlugName) {
+		case FieldPublicKey:
+			publicKey = true
+		case FieldPrivateKey:
+			privateKey = true
+		case FieldPrivateKeyPassphrase:
+			passphrase = true
+		}
+	}
+
+	var missing []string
+	if args.GenerateSshKeys && !publicKey {
+		missing = append(missing, FieldPublicKey+" field")
+	}
+	if args.GenerateSshKeys && !privateKey {
+		missing = append(missing, FieldPrivateKey+" field")
+	}
+	if args.GeneratePassphrase && !passphrase {
+		missing = append(missing, FieldPrivateKeyPassphrase+" field")
+	}
+	if len(missing) > 0 {
+		return &SshGenerationError{TemplateID: s.ID, TemplateName: s.Name, Missing: missing}
+	}
+	return nil
+}
+
 // SecretTemplate gets the secret template with id from the Secret Server of the given tenant
 func (s *Server) SecretTemplate(ctx context.Context, id int) (*SecretTemplate, error) {
-	l := ctxzap.Extract(ctx)
+	l := s.log(ctx)
+	if s.templateCache != nil {
+		return s.cachedSecretTemplate(ctx, id)
+	}
 	secretTemplate := new(SecretTemplate)
 
 	if data, err := s.accessResource(ctx, http.MethodGet, templateResource, strconv.Itoa(id), nil); err == nil {
@@ -45,12 +147,140 @@ func (s *Server) SecretTemplate(ctx context.Context, id int) (*SecretTemplate, e
 	return secretTemplate, nil
 }
 
+// creatableTemplatesFilter is the query parameter which restricts the secret
+// templates list to those the current user can create secrets from
+const creatableTemplatesFilter = "filter.createSecretPermissionOnly"
+
+// defaultTemplatePageSize is the number of secret templates requested per page
+const defaultTemplatePageSize = 100
+
+// templateSearchResult is a page of secret templates
+type templateSearchResult struct {
+	Skip, NextSkip int
+	HasNext        bool
+	Records        []SecretTemplate
+}
+
+func (p *templateSearchResult) paging() (int, bool, int) {
+	return p.NextSkip, p.HasNext, len(p.Records)
+}
+
+// CreatableTemplates gets the secret templates that the current user can create
+// secrets from, paging through all of the results. The templates of the list
+// do not carry their fields; use SecretTemplate to get those.
+func (s *Server) CreatableTemplates(ctx context.Context) ([]SecretTemplate, error) {
+	l := s.log(ctx)
+
+	templates := make([]SecretTemplate, 0)
+	err := eachPage(func(skip int) (resultPage, error) {
+		query := url.Values{
+			creatableTemplatesFilter: {"true"},
+			"skip":                   {strconv.Itoa(skip)},
+			"take":                   {strconv.Itoa(defaultTemplatePageSize)},
+		}
+
+		page := new(templateSearchResult)
+		data, err := s.accessResource(ctx, http.MethodGet, templateResource, withQuery("/", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, page); err != nil {
+			l.Error("error parsing secret templates response", zap.Int("skip", skip), zap.String("data", string(data)))
+			return nil, err
+		}
+		templates = append(templates, page.Records...)
+		return page, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// templateCache holds the secret templates fetched by a Server with
+// WithTemplateCache, along with the ETag each was served with
+type templateCache struct {
+	mu sync.Mutex
+	// validate is set by WithTemplateCacheValidation
+	validate bool
+	entries  map[int]templateCacheEntry
+}
+
+type templateCacheEntry struct {
+	template SecretTemplate
+	etag     string
+}
+
+func (c *templateCache) get(id int) (templateCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[id]
+	return entry, found
+}
+
+func (c *templateCache) set(id int, entry templateCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = entry
+}
+
+// clone returns a copy of the template whose fields can be changed without
+// changing the cached template
+func (s SecretTemplate) clone() *SecretTemplate {
+	s.Fields = append([]SecretTemplateField(nil), s.Fields...)
+	return &s
+}
+
+// cachedSecretTemplate gets the secret template with id from the template
+// cache, fetching it when it is not cached yet. With validation, the cached
+// template is only used when the server answers a conditional request with its
+// ETag as not modified, and is replaced otherwise.
+func (s *Server) cachedSecretTemplate(ctx context.Context, id int) (*SecretTemplate, error) {
+	l := s.log(ctx)
+
+	entry, found := s.templateCache.get(id)
+	if found && !s.templateCache.validate {
+		return entry.template.clone(), nil
+	}
+
+	var header http.Header
+	if found && entry.etag != "" {
+		header = http.Header{"If-None-Match": {entry.etag}}
+	}
+
+	res, err := s.accessResourceResponse(ctx, http.MethodGet, templateResource, strconv.Itoa(id), nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if found && res.StatusCode == http.StatusNotModified {
+		l.Debug("the cached secret template is current", zap.Int("secret_template_id", id), zap.String("etag", entry.etag))
+		return entry.template.clone(), nil
+	}
+	data, err := s.readResponse(ctx, res)
+	if err != nil {
+		return nil, err
+	}
+
+	template := SecretTemplate{}
+	if err = json.Unmarshal(data, &template); err != nil {
+		l.Error("error parsing secret template response", zap.Int("secret_template_id", id), zap.String("data", string(data)))
+		return nil, err
+	}
+	if found {
+		l.Debug("the cached secret template changed, refreshing it", zap.Int("secret_template_id", id), zap.String("etag", res.Header.Get("ETag")))
+	}
+	s.templateCache.set(id, templateCacheEntry{template: template, etag: res.Header.Get("ETag")})
+	return template.clone(), nil
+}
+
 // GeneratePassword generates and returns a password for the secret field identified by the given slug on the given
 // template. The password adheres to the password requirements associated with the field. NOTE: this should only be
 // used with fields whose IsPassword property is true.
 func (s *Server) GeneratePassword(ctx context.Context, slug string, template *SecretTemplate) (string, error) {
-	l := ctxzap.Extract(ctx)
-	fieldId, found := template.FieldSlugToId(ctx, slug)
+	l := s.log(ctx)
+	fieldId, found := template.FieldSlugToId(s.logContext(ctx), slug)
 
 	if !found {
 		l.Error("the alias does not identify a field on the template", zap.String("alias", slug), zap.String("template_name", template.Name))
@@ -65,6 +295,85 @@ func (s *Server) GeneratePassword(ctx context.Context, slug string, template *Se
 	}
 }
 
+// PasswordRequirements is the password policy of a password field, which is
+// what GeneratePassword adheres to
+type PasswordRequirements struct {
+	ID                   int
+	Name, Description    string
+	MinLength, MaxLength int
+	RequiredCharacters   []PasswordCharacterSet
+}
+
+// PasswordCharacterSet is a character class of PasswordRequirements along with
+// how many of its characters a password must contain
+type PasswordCharacterSet struct {
+	CharacterSetID   int
+	CharacterSetName string
+	MinimumRequired  int
+}
+
+// PasswordRequirements gets the password requirements of the secret field
+// identified by the given slug on the given template, so that they can be
+// displayed before calling GeneratePassword
+func (s *Server) PasswordRequirements(ctx context.Context, slug string, template *SecretTemplate) (*PasswordRequirements, error) {
+	l := s.log(ctx)
+	fieldId, found := template.FieldSlugToId(s.logContext(ctx), slug)
+
+	if !found {
+		l.Error("the alias does not identify a field on the template", zap.String("alias", slug), zap.String("template_name", template.Name))
+		return nil, fmt.Errorf("[ERROR] the alias '%s' does not identify a field on the template named '%s'", slug, template.Name)
+	}
+	resourcePath := path.Join(strconv.Itoa(template.ID), "fields", strconv.Itoa(fieldId), "password-requirements")
+
+	requirements := new(PasswordRequirements)
+	if data, err := s.accessResource(ctx, http.MethodGet, templateResource, resourcePath, nil); err == nil {
+		if err = json.Unmarshal(data, requirements); err != nil {
+			l.Error("error parsing password requirements response", zap.String("slug", slug), zap.String("data", string(data)))
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return requirements, nil
+}
+
+// FieldListOptions gets the allowed values of the list field identified by the
+// given slug on the given template, so that they can be offered as choices or
+// used to validate the value of the field
+func (s *Server) FieldListOptions(ctx context.Context, slug string, template *SecretTemplate) ([]string, error) {
+	l := s.log(ctx)
+	field, found := template.GetField(s.logContext(ctx), slug)
+
+	if !found {
+		return nil, fmt.Errorf("[ERROR] the alias '%s' does not identify a field on the template named '%s'", slug, template.Name)
+	}
+	if !field.IsList {
+		return nil, fmt.Errorf("[ERROR] the field '%s' on the template named '%s' is not a list", slug, template.Name)
+	}
+	resourcePath := path.Join(strconv.Itoa(template.ID), "fields", strconv.Itoa(field.SecretTemplateFieldID), "list-options")
+
+	options := struct {
+		Records []struct {
+			Value string
+		}
+	}{}
+	if data, err := s.accessResource(ctx, http.MethodGet, templateResource, resourcePath, nil); err == nil {
+		if err = json.Unmarshal(data, &options); err != nil {
+			l.Error("error parsing list options response", zap.String("slug", slug), zap.String("data", string(data)))
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	values := make([]string, 0, len(options.Records))
+	for _, option := range options.Records {
+		values = append(values, option.Value)
+	}
+	return values, nil
+}
+
 // FieldIdToSlug returns the shorthand alias (aka: "slug") of the field with the given field ID, and a boolean
 // indicating whether the given ID actually identifies a field for the secret template.
 func (s SecretTemplate) FieldIdToSlug(ctx context.Context, fieldId int) (string, bool) {
@@ -89,6 +398,27 @@ func (s SecretTemplate) FieldSlugToId(ctx context.Context, slug string) (int, bo
 	return 0, found
 }
 
+// DisplayNameToSlug returns the shorthand alias (aka: "slug") of the field with the given display name, matched
+// case-insensitively, and a boolean indicating whether the display name identifies a field for the secret template. An
+// exact match is preferred over one which differs only in case.
+func (s SecretTemplate) DisplayNameToSlug(ctx context.Context, displayName string) (string, bool) {
+	l := ctxzap.Extract(ctx)
+	for _, field := range s.Fields {
+		if displayName == field.DisplayName {
+			l.Debug("template field with slug matches the given display name", zap.String("slug", field.FieldSlugName), zap.String("display_name", displayName))
+			return field.FieldSlugName, true
+		}
+	}
+	for _, field := range s.Fields {
+		if strings.EqualFold(displayName, field.DisplayName) {
+			l.Debug("template field with slug matches the given display name", zap.String("slug", field.FieldSlugName), zap.String("display_name", displayName))
+			return field.FieldSlugName, true
+		}
+	}
+	l.Error("no matching template field with display name", zap.String("display_name", displayName), zap.String("template_name", s.Name))
+	return "", false
+}
+
 // GetField returns the field with the given shorthand alias (aka: "slug"), and a boolean indicating whether the given
 // slug actually identifies a field for the secret template .
 func (s SecretTemplate) GetField(ctx context.Context, slug string) (*SecretTemplateField, bool) {
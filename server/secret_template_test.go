@@ -2,7 +2,13 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestSecretTemplate tests SecretTemplate. Referred to as
@@ -78,3 +84,297 @@ func VerifySecretTemplate(t *testing.T, tss *Server) {
 		}
 	}
 }
+
+// TestValidateFieldSlugs asserts that ValidateFieldSlugs reports each slug
+// shared by more than one field of the template, ignoring fields without one.
+func TestValidateFieldSlugs(t *testing.T) {
+	template := SecretTemplate{
+		Name: "Test Template",
+		Fields: []SecretTemplateField{
+			{SecretTemplateFieldID: 1, FieldSlugName: "username"},
+			{SecretTemplateFieldID: 2, FieldSlugName: "password"},
+			{SecretTemplateFieldID: 3, FieldSlugName: "notes"},
+			{SecretTemplateFieldID: 7},
+			{SecretTemplateFieldID: 8},
+		},
+	}
+	if err := template.ValidateFieldSlugs(); err != nil {
+		t.Errorf("expected no error for unique slugs and fields without one, but got '%s'", err)
+	}
+
+	template.Fields = append(template.Fields,
+		SecretTemplateField{SecretTemplateFieldID: 4, FieldSlugName: "password"},
+		SecretTemplateField{SecretTemplateFieldID: 5, FieldSlugName: "password"},
+		SecretTemplateField{SecretTemplateFieldID: 6, FieldSlugName: "notes"},
+	)
+	err := template.ValidateFieldSlugs()
+	var collision *SlugCollisionError
+	if !errors.As(err, &collision) {
+		t.Fatalf("expected a SlugCollisionError, but got '%v'", err)
+	}
+	if len(collision.Slugs) != 2 || collision.Slugs[0] != "password" || collision.Slugs[1] != "notes" {
+		t.Errorf("expected the colliding slugs to be [password notes], but found %v", collision.Slugs)
+	}
+}
+
+// TestDisplayNameToSlug asserts that DisplayNameToSlug matches a display name
+// exactly or in another case, and reports a miss.
+func TestDisplayNameToSlug(t *testing.T) {
+	ctx := context.Background()
+	template := SecretTemplate{
+		Name: "Test Template",
+		Fields: []SecretTemplateField{
+			{SecretTemplateFieldID: 1, FieldSlugName: "username", DisplayName: "User Name"},
+			{SecretTemplateFieldID: 2, FieldSlugName: "password", DisplayName: "Password"},
+			{SecretTemplateFieldID: 3, FieldSlugName: "password-hint", DisplayName: "password"},
+		},
+	}
+
+	tests := []struct {
+		name, displayName, slug string
+		found                   bool
+	}{
+		{"exact", "User Name", "username", true},
+		{"case variation", "USER name", "username", true},
+		{"exact preferred", "password", "password-hint", true},
+		{"miss", "Machine", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slug, found := template.DisplayNameToSlug(ctx, tt.displayName)
+			validate("found", tt.found, found, t)
+			validate("slug", tt.slug, slug, t)
+		})
+	}
+}
+
+// TestPasswordRequirements asserts that PasswordRequirements parses the
+// requirements of a password field, with its required character classes.
+func TestPasswordRequirements(t *testing.T) {
+	ctx := context.Background()
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/secret-templates/6/fields/11/password-requirements" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{
+			"id": 1,
+			"name": "Default",
+			"description": "The default password requirements",
+			"minLength": 12,
+			"maxLength": 64,
+			"requiredCharacters": [
+				{"characterSetId": 1, "characterSetName": "Upper Case", "minimumRequired": 1},
+				{"characterSetId": 3, "characterSetName": "Numbers", "minimumRequired": 2}
+			]
+		}`))
+	}))
+
+	template := new(SecretTemplate)
+	if err := json.Unmarshal([]byte(testTemplateJSON), template); err != nil {
+		t.Fatal("parsing the test template:", err)
+	}
+
+	requirements, err := tss.PasswordRequirements(ctx, "password", template)
+	if err != nil {
+		t.Fatal("calling server.PasswordRequirements:", err)
+	}
+	validate("min length", 12, requirements.MinLength, t)
+	validate("max length", 64, requirements.MaxLength, t)
+	if len(requirements.RequiredCharacters) != 2 {
+		t.Fatalf("expected 2 required character sets, but found %d", len(requirements.RequiredCharacters))
+	}
+	validate("character set name", "Numbers", requirements.RequiredCharacters[1].CharacterSetName, t)
+	validate("minimum required", 2, requirements.RequiredCharacters[1].MinimumRequired, t)
+
+	if _, err := tss.PasswordRequirements(ctx, "nonexistent", template); err == nil {
+		t.Error("expected an error for a slug which is not on the template")
+	}
+}
+
+// TestFieldListOptions asserts that FieldListOptions parses the allowed values
+// of a list field, and refuses fields which are not lists.
+func TestFieldListOptions(t *testing.T) {
+	ctx := context.Background()
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/secret-templates/6/fields/13/list-options" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"records": [{"value": "Production"}, {"value": "Staging"}, {"value": "Development"}]}`))
+	}))
+
+	template := new(SecretTemplate)
+	if err := json.Unmarshal([]byte(testTemplateJSON), template); err != nil {
+		t.Fatal("parsing the test template:", err)
+	}
+	template.Fields = append(template.Fields, SecretTemplateField{
+		SecretTemplateFieldID: 13, FieldSlugName: "environment", IsList: true, ListType: "Generic",
+	})
+
+	options, err := tss.FieldListOptions(ctx, "environment", template)
+	if err != nil {
+		t.Fatal("calling server.FieldListOptions:", err)
+	}
+	expected := []string{"Production", "Staging", "Development"}
+	if len(options) != len(expected) {
+		t.Fatalf("expected %d list options, but found %v", len(expected), options)
+	}
+	for i, option := range options {
+		validate("list option", expected[i], option, t)
+	}
+
+	if _, err := tss.FieldListOptions(ctx, "username", template); err == nil {
+		t.Error("expected an error for a field which is not a list")
+	}
+}
+
+// TestCreatableTemplates asserts that CreatableTemplates requests the list of
+// templates filtered to those the user can create secrets from, across pages.
+func TestCreatableTemplates(t *testing.T) {
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/api/v1/secret-templates/" || query.Get(creatableTemplatesFilter) != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if query.Get("skip") == "0" {
+			w.Write([]byte(`{"skip": 0, "nextSkip": 2, "hasNext": true, "records": [
+				{"id": 2, "name": "Windows Account"},
+				{"id": 6, "name": "Test Template"}
+			]}`))
+		} else {
+			w.Write([]byte(`{"skip": 2, "nextSkip": 3, "hasNext": false, "records": [
+				{"id": 9, "name": "Web Password"}
+			]}`))
+		}
+	}))
+
+	templates, err := tss.CreatableTemplates(context.Background())
+	if err != nil {
+		t.Fatal("calling server.CreatableTemplates:", err)
+	}
+	if len(templates) != 3 {
+		t.Fatalf("expected 3 templates across the pages, but found %d", len(templates))
+	}
+	validate("template id", 6, templates[1].ID, t)
+	validate("template name", "Web Password", templates[2].Name, t)
+}
+
+// TestTemplateCacheValidation asserts that a cached template is used while the
+// server reports its ETag as not modified, and is fetched again once the
+// template is edited, while WithTemplateCache alone trusts the cache.
+func TestTemplateCacheValidation(t *testing.T) {
+	var mu sync.Mutex
+	version, fetches, notModified := 1, 0, 0
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/secret-templates/6" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches++
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"id": 6, "name": "Test Template", "fields": [
+			{"secretTemplateFieldId": 10, "fieldSlugName": "username"},
+			{"secretTemplateFieldId": 11, "fieldSlugName": "password-v%d"}
+		]}`, version)
+	})
+	ctx := context.Background()
+
+	tss, _ := newTestServer(t, handler, WithTemplateCacheValidation())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tss.SecretTemplate(ctx, 6); err != nil {
+				t.Error("calling server.SecretTemplate:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	template, err := tss.SecretTemplate(ctx, 6)
+	if err != nil {
+		t.Fatal("calling server.SecretTemplate:", err)
+	}
+	validate("cached field", "password-v1", template.Fields[1].FieldSlugName, t)
+	template.Fields[1].FieldSlugName = "changed by the caller"
+	if notModified == 0 {
+		t.Error("expected the cached template to be validated with its ETag")
+	}
+
+	mu.Lock()
+	version, fetches = 2, 0
+	mu.Unlock()
+	template, err = tss.SecretTemplate(ctx, 6)
+	if err != nil {
+		t.Fatal("calling server.SecretTemplate:", err)
+	}
+	validate("refreshed field", "password-v2", template.Fields[1].FieldSlugName, t)
+	validate("fetches after the edit", 1, fetches, t)
+
+	template, err = tss.SecretTemplate(ctx, 6)
+	if err != nil {
+		t.Fatal("calling server.SecretTemplate:", err)
+	}
+	validate("cached field after the edit", "password-v2", template.Fields[1].FieldSlugName, t)
+	validate("fetches of the current template", 1, fetches, t)
+
+	// without validation, the cached template is trusted even once edited
+	tss, _ = newTestServer(t, handler, WithTemplateCache())
+	if _, err := tss.SecretTemplate(ctx, 6); err != nil {
+		t.Fatal("calling server.SecretTemplate:", err)
+	}
+	mu.Lock()
+	version, fetches, notModified = 3, 0, 0
+	mu.Unlock()
+	template, err = tss.SecretTemplate(ctx, 6)
+	if err != nil {
+		t.Fatal("calling server.SecretTemplate:", err)
+	}
+	validate("trusted field", "password-v2", template.Fields[1].FieldSlugName, t)
+	validate("requests of a trusted template", 0, fetches+notModified, t)
+}
+
+// TestTemplateCacheRetry asserts that the conditional request of a validated
+// template cache goes through the retries of accessResource.
+func TestTemplateCacheRetry(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/secret-templates/6" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		requests++
+		throttled := requests == 1
+		mu.Unlock()
+		if throttled {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(testTemplateJSON))
+	}), WithTemplateCacheValidation(), WithRequestRetries(2), WithBackoff(ConstantBackoff{Delay: time.Millisecond}))
+
+	template, err := tss.SecretTemplate(context.Background(), 6)
+	if err != nil {
+		t.Fatal("calling server.SecretTemplate:", err)
+	}
+	validate("template id", 6, template.ID, t)
+	validate("requests", 2, requests, t)
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,9 +18,10 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/jirwin/ctxzap"
+	"github.com/jirwin/tss-sdk-go/internal/version"
 	"go.uber.org/zap"
 )
 
@@ -30,6 +32,17 @@ const (
 	defaultTLD           string = "com"
 )
 
+// CloudBaseURL returns the base URL of the Secret Server Cloud tenant with the
+// given TLD ("com" when it is empty), as a Server configured with the Tenant
+// and TLD uses it, so that tooling can reach the tenant without a Server
+func CloudBaseURL(tenant, tld string) string {
+	tld = strings.Trim(strings.TrimSpace(tld), ".")
+	if tld == "" {
+		tld = defaultTLD
+	}
+	return fmt.Sprintf(cloudBaseURLTemplate, strings.TrimSpace(tenant), tld)
+}
+
 // UserCredential holds the username and password that the API should use to
 // authenticate to the REST API
 type UserCredential struct {
@@ -43,10 +56,134 @@ type Configuration struct {
 	TLSClientConfig                                  *tls.Config
 }
 
+// UsernameFormat controls how the username and domain are presented to the
+// token endpoint during the password grant
+type UsernameFormat int
+
+const (
+	// UsernameFormatSeparate sends the bare username with a separate domain
+	// form field (the default)
+	UsernameFormatSeparate UsernameFormat = iota
+	// UsernameFormatUPN sends the username as user@domain
+	UsernameFormatUPN
+	// UsernameFormatDownLevel sends the username as DOMAIN\user
+	UsernameFormatDownLevel
+)
+
+var (
+	tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+	tldPattern    = regexp.MustCompile(`^[a-zA-Z]{2,}(\.[a-zA-Z]{2,})*$`)
+)
+
+// errMissingEndpoint is returned by Validate when neither the ServerURL nor the
+// Tenant is set; New accepts it when a tenant resolver is configured
+var errMissingEndpoint = errors.New("either ServerURL of Secret Server/Platform or Tenant of Secret Server Cloud must be set")
+
+// errMissingCredentials is returned by Validate when the configuration has no
+// credentials; New accepts it when the credentials are supplied by an option
+var errMissingCredentials = errors.New("one of the Password, Token or Domain credentials must be set")
+
+// Validate checks the configuration for errors, normalizing the ServerURL,
+// Tenant and TLD in the process. It is called by New, but is exported so that
+// callers building a Configuration dynamically can check it beforehand.
+func (c *Configuration) Validate() error {
+	c.ServerURL = strings.TrimRight(strings.TrimSpace(c.ServerURL), "/")
+	c.Tenant = strings.TrimSpace(c.Tenant)
+	c.TLD = strings.Trim(strings.TrimSpace(c.TLD), ".")
+
+	if c.ServerURL != "" && c.Tenant != "" {
+		return fmt.Errorf("either ServerURL of Secret Server/Platform or Tenant of Secret Server Cloud must be set")
+	}
+	if c.ServerURL != "" {
+		u, err := url.Parse(c.ServerURL)
+		if err != nil {
+			return fmt.Errorf("invalid ServerURL '%s': %w", c.ServerURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid ServerURL '%s': an http or https URL with a host is required", c.ServerURL)
+		}
+	}
+	if c.TLD != "" && !tldPattern.MatchString(c.TLD) {
+		return fmt.Errorf("invalid TLD '%s'", c.TLD)
+	}
+	if c.Tenant != "" {
+		if err := validateTenant(c.Tenant, c.TLD); err != nil {
+			return err
+		}
+	}
+	if c.Credentials.Password == "" && c.Credentials.Token == "" && c.Credentials.Domain == "" {
+		return errMissingCredentials
+	}
+	if c.ServerURL == "" && c.Tenant == "" {
+		return errMissingEndpoint
+	}
+
+	return nil
+}
+
+// validateTenant checks that the tenant is a bare DNS label, rather than a URL
+// or a host name, and that the base URL built from it and the TLD parses with
+// the expected host, so that a bad Tenant fails when the Server is configured
+// rather than on its first request
+func validateTenant(tenant, tld string) error {
+	switch {
+	case strings.Contains(tenant, "://"):
+		return fmt.Errorf("invalid Tenant '%s': the Tenant is the bare name of the tenant, not a URL; use ServerURL for a full URL", tenant)
+	case strings.ContainsAny(tenant, "/\\"):
+		return fmt.Errorf("invalid Tenant '%s': the Tenant must not contain slashes", tenant)
+	case strings.Contains(tenant, "."):
+		return fmt.Errorf("invalid Tenant '%s': the Tenant is the bare name of the tenant, without the secretservercloud domain", tenant)
+	case len(tenant) > 63:
+		return fmt.Errorf("invalid Tenant '%s': the Tenant must be at most 63 characters", tenant)
+	case !tenantPattern.MatchString(tenant):
+		return fmt.Errorf("invalid Tenant '%s': only letters, digits and hyphens are allowed", tenant)
+	}
+
+	if tld == "" {
+		tld = defaultTLD
+	}
+	baseURL := CloudBaseURL(tenant, tld)
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid Tenant '%s' or TLD '%s': the base URL %s does not parse: %w", tenant, tld, baseURL, err)
+	}
+	if expected := tenant + ".secretservercloud." + tld; u.Hostname() != expected {
+		return fmt.Errorf("invalid Tenant '%s' or TLD '%s': the base URL %s does not have the host %s", tenant, tld, baseURL, expected)
+	}
+	return nil
+}
+
 // Server provides access to secrets stored in Delinea Secret Server
 type Server struct {
 	Configuration
-	httpClient *http.Client
+	httpClient                     *http.Client
+	usernameFormat                 UsernameFormat
+	verboseLogging                 bool
+	skipFileDownload               bool
+	clientID, clientSecret         string
+	endpointOverrides              map[string]string
+	fieldNameMapper                func(string) string
+	otpProvider                    func(ctx context.Context) (string, error)
+	tenantResolver                 func(ctx context.Context) (tenant, tld string, err error)
+	backoff                        Backoff
+	sdkClient                      *sdkClientAuth
+	defaultFolderID, defaultSiteID int
+	secretsBudget                  time.Duration
+	requestMaxAttempts             int
+	staticTokenRefresher           *staticTokenRefresher
+	roundTripper                   http.RoundTripper
+	httpTrace                      bool
+	autoPopulateSlugs              bool
+	disableTokenCache              bool
+	logger                         *zap.Logger
+	fileFieldPredicate             func(SecretField) bool
+	logSampler                     *debugSampler
+	folderScopedCreate             bool
+	templateCache                  *templateCache
+	dialer                         *net.Dialer
+	tokenStore                     TokenStore
+	noResultsError                 bool
+	versionCache                   serverVersionCache
 }
 
 type ServerOption func(server *Server)
@@ -57,6 +194,320 @@ func WithHttpClient(client *http.Client) ServerOption {
 	}
 }
 
+// WithRoundTripper sets the transport of the HTTP client of the Server, which
+// is otherwise http.DefaultTransport or that of the client set by
+// WithHttpClient, so that requests can be wrapped for authentication, logging
+// or recording. A TLSClientConfig is only applied to an *http.Transport.
+func WithRoundTripper(roundTripper http.RoundTripper) ServerOption {
+	return func(server *Server) {
+		server.roundTripper = roundTripper
+	}
+}
+
+// WithDialer sets the dialer which the transport of the HTTP client opens
+// connections with, so that IPv6-only environments can use a dual-stack dialer
+// with FallbackDelay or a custom Resolver. It is applied along with a
+// TLSClientConfig, and the proxy settings of the transport are kept; like a
+// TLSClientConfig, it requires the transport to be an *http.Transport.
+func WithDialer(dialer *net.Dialer) ServerOption {
+	return func(server *Server) {
+		server.dialer = dialer
+	}
+}
+
+// WithLogger sets the logger which the Server logs to when the context of a
+// call does not carry one, in place of discarding the logs. A logger put in the
+// context with ctxzap.ToContext still takes precedence.
+func WithLogger(logger *zap.Logger) ServerOption {
+	return func(server *Server) {
+		server.logger = logger
+	}
+}
+
+// WithLogSampling keeps only 1 in n of the Debug logs of the Server, such as
+// the "calling API" log of every request, to reduce the log volume of bulk
+// operations. Logs at Info level and above, errors included, are never
+// sampled. An n of 1 or less keeps every log.
+func WithLogSampling(n int) ServerOption {
+	return func(server *Server) {
+		if n > 1 {
+			server.logSampler = &debugSampler{n: uint64(n)}
+		} else {
+			server.logSampler = nil
+		}
+	}
+}
+
+// WithHTTPTrace logs the DNS, connect, TLS handshake and first response byte
+// timings of the token and API requests at Debug level, to diagnose slow or
+// failing connections
+func WithHTTPTrace() ServerOption {
+	return func(server *Server) {
+		server.httpTrace = true
+	}
+}
+
+// WithVerboseLogging logs the request and response bodies at Debug level, with
+// the values of all fields, tokens and the password form parameter masked.
+// This is meant for troubleshooting only.
+func WithVerboseLogging() ServerOption {
+	return func(server *Server) {
+		server.verboseLogging = true
+	}
+}
+
+// WithoutAutoFileDownload stops Secret from downloading the file attachments of
+// the secret; their ItemValue is left as returned by the server, and they can
+// be downloaded later with ResolveAttachments
+func WithoutAutoFileDownload() ServerOption {
+	return func(server *Server) {
+		server.skipFileDownload = true
+	}
+}
+
+// WithFileFieldPredicate replaces the check of which fields of a secret hold a
+// file attachment to download, which by default requires IsFile, a
+// FileAttachmentID and a Filename, for templates which mark their file fields
+// differently. It applies to Secret, ResolveAttachments and CopySecret.
+func WithFileFieldPredicate(predicate func(SecretField) bool) ServerOption {
+	return func(server *Server) {
+		server.fileFieldPredicate = predicate
+	}
+}
+
+// WithClientCredentials authenticates with the OAuth2 client_credentials grant
+// using the given API client ID and secret instead of the password grant
+func WithClientCredentials(clientID, clientSecret string) ServerOption {
+	return func(server *Server) {
+		server.clientID = clientID
+		server.clientSecret = clientSecret
+	}
+}
+
+// WithEndpointOverride routes requests for the resources in the map (keyed by
+// "secrets", "secret-templates", "token" and so on) to the base URL they map
+// to rather than the configured ServerURL or Tenant. This is meant for contract
+// tests against mocks and for canary routing.
+func WithEndpointOverride(overrides map[string]string) ServerOption {
+	return func(server *Server) {
+		server.endpointOverrides = make(map[string]string, len(overrides))
+		for resource, baseURL := range overrides {
+			server.endpointOverrides[resource] = baseURL
+		}
+	}
+}
+
+// WithDisableTokenCache stops the Server from caching its access tokens, so
+// that every request obtains a fresh grant from the token endpoint, for
+// security policies which forbid caching tokens
+func WithDisableTokenCache() ServerOption {
+	return func(server *Server) {
+		server.disableTokenCache = true
+	}
+}
+
+// WithTokenStore keeps the access tokens of the Server in the store, in place
+// of the environment of the process, so that Servers sharing the store reuse
+// each other's tokens. WithDisableTokenCache takes precedence.
+func WithTokenStore(store TokenStore) ServerOption {
+	return func(server *Server) {
+		server.tokenStore = store
+	}
+}
+
+// WithNoResultsError makes Secrets and SecretsWithFilters return ErrNoResults,
+// along with the empty slice, when a search matches no secrets, rather than
+// no error. SearchSecrets reports the same through its SecretsResult.
+func WithNoResultsError() ServerOption {
+	return func(server *Server) {
+		server.noResultsError = true
+	}
+}
+
+// WithFolderScopedCreate makes CreateSecret POST a secret with a FolderID to
+// the folder-scoped path, folders/{FolderID}/secrets, rather than to secrets,
+// for deployments which require the folder in the request path. Secrets
+// without a folder are created through the secrets path as usual.
+func WithFolderScopedCreate() ServerOption {
+	return func(server *Server) {
+		server.folderScopedCreate = true
+	}
+}
+
+// WithTemplateCache caches the secret templates fetched by the Server, which
+// every write fetches, for the lifetime of the Server. Use
+// WithTemplateCacheValidation when templates may be edited meanwhile.
+func WithTemplateCache() ServerOption {
+	return func(server *Server) {
+		if server.templateCache == nil {
+			server.templateCache = &templateCache{entries: make(map[int]templateCacheEntry)}
+		}
+	}
+}
+
+// WithTemplateCacheValidation caches the secret templates like
+// WithTemplateCache, but only uses a cached template after checking with the
+// server, by its ETag, that it has not been edited since; an edited template
+// is fetched again. This spares the body of the template rather than the
+// request.
+func WithTemplateCacheValidation() ServerOption {
+	return func(server *Server) {
+		WithTemplateCache()(server)
+		server.templateCache.validate = true
+	}
+}
+
+// WithAutoPopulateSlugs fills in the Slug of each field written by CreateSecret
+// and UpdateSecret which only has its FieldID set, from the template of the
+// secret, before the request is sent
+func WithAutoPopulateSlugs() ServerOption {
+	return func(server *Server) {
+		server.autoPopulateSlugs = true
+	}
+}
+
+// WithFieldNameMapper applies the mapper to every JSON key of the secrets
+// written by CreateSecret and UpdateSecret, so that callers can adapt to the
+// casing or naming quirks a deployment expects
+func WithFieldNameMapper(mapper func(string) string) ServerOption {
+	return func(server *Server) {
+		server.fieldNameMapper = mapper
+	}
+}
+
+// WithOTPProvider supplies the one-time password used to answer the
+// multi-factor challenge of the password grant for accounts which require it.
+// The provider is only called when the token endpoint issues the challenge.
+func WithOTPProvider(provider func(ctx context.Context) (string, error)) ServerOption {
+	return func(server *Server) {
+		server.otpProvider = provider
+	}
+}
+
+// WithDefaultFolderID sets the folder in which CreateSecret creates secrets
+// that leave their FolderID zero
+func WithDefaultFolderID(folderID int) ServerOption {
+	return func(server *Server) {
+		server.defaultFolderID = folderID
+	}
+}
+
+// WithDefaultSiteID sets the site of the secrets created by CreateSecret that
+// leave their SiteID zero
+func WithDefaultSiteID(siteID int) ServerOption {
+	return func(server *Server) {
+		server.defaultSiteID = siteID
+	}
+}
+
+// WithSecretsBudget limits the time taken by Secrets and SecretsWithFilters,
+// for the search and the fetch of every secret found, to the given budget.
+// Fetches still outstanding when it runs out are cancelled.
+func WithSecretsBudget(budget time.Duration) ServerOption {
+	return func(server *Server) {
+		server.secretsBudget = budget
+	}
+}
+
+// WithRequestRetries retries API requests, including writes, which fail in a
+// way IsRetryable classifies as retryable, such as 429 and 503 responses or a
+// refused connection, until the given number of attempts have been made,
+// waiting according to the Backoff between attempts. Requests are not retried
+// by default.
+func WithRequestRetries(maxAttempts int) ServerOption {
+	return func(server *Server) {
+		server.requestMaxAttempts = maxAttempts
+	}
+}
+
+// WithTokenPath sets the path of the OAuth2 token endpoint, relative to the
+// server URL, which is /oauth2/token by default, for deployments behind a
+// reverse proxy which relocates it
+func WithTokenPath(path string) ServerOption {
+	return func(server *Server) {
+		if path = strings.Trim(path, "/"); path != "" {
+			server.tokenPathURI = path
+		}
+	}
+}
+
+// WithStaticTokenRefresher sets a callback which supplies a new token, when
+// the static Credentials.Token is rejected with a 401, with which the request
+// is retried once
+func WithStaticTokenRefresher(refresh func(ctx context.Context) (string, error)) ServerOption {
+	return func(server *Server) {
+		server.staticTokenRefresher = &staticTokenRefresher{refresh: refresh}
+	}
+}
+
+// staticTokenRefresher guards the refreshes of the static token
+type staticTokenRefresher struct {
+	mu      sync.Mutex
+	refresh func(ctx context.Context) (string, error)
+}
+
+// staticToken is the static Credentials.Token, which may have been refreshed
+func (s *Server) staticToken() string {
+	if s.staticTokenRefresher == nil {
+		return s.Credentials.Token
+	}
+	s.staticTokenRefresher.mu.Lock()
+	defer s.staticTokenRefresher.mu.Unlock()
+	return s.Credentials.Token
+}
+
+// refreshStaticToken replaces the rejected static token with one from the
+// refresher, unless a concurrent request has already replaced it
+func (s *Server) refreshStaticToken(ctx context.Context, rejected string) (string, error) {
+	s.staticTokenRefresher.mu.Lock()
+	defer s.staticTokenRefresher.mu.Unlock()
+
+	if s.Credentials.Token != rejected {
+		return s.Credentials.Token, nil
+	}
+	token, err := s.staticTokenRefresher.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", errors.New("the static token refresher returned an empty token")
+	}
+	s.Credentials.Token = token
+	return token, nil
+}
+
+// SDKVersion returns the semantic version of the SDK
+func SDKVersion() string {
+	return version.SDKVersion()
+}
+
+// WithBackoff sets the strategy for the delay between retries of throttled
+// token and API requests, which is a full-jitter ExponentialBackoff by default. A
+// Retry-After header sent by the server still takes precedence.
+func WithBackoff(backoff Backoff) ServerOption {
+	return func(server *Server) {
+		server.backoff = backoff
+	}
+}
+
+// WithTenantResolver determines the Secret Server Cloud tenant, and optionally
+// the TLD, on every request rather than at construction, for multi-tenant
+// services. The Configuration must not set a ServerURL in this case, and its
+// Tenant is ignored. Access tokens are cached per resolved tenant.
+func WithTenantResolver(resolver func(ctx context.Context) (tenant, tld string, err error)) ServerOption {
+	return func(server *Server) {
+		server.tenantResolver = resolver
+	}
+}
+
+// WithUsernameFormat sets how the credentials' username and domain are
+// assembled into the password grant request
+func WithUsernameFormat(format UsernameFormat) ServerOption {
+	return func(server *Server) {
+		server.usernameFormat = format
+	}
+}
+
 type TokenCache struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   int    `json:"expires_in"`
@@ -64,8 +515,9 @@ type TokenCache struct {
 
 // New returns an initialized Secrets object
 func New(config Configuration, opts ...ServerOption) (*Server, error) {
-	if config.ServerURL == "" && config.Tenant == "" || config.ServerURL != "" && config.Tenant != "" {
-		return nil, fmt.Errorf("either ServerURL of Secret Server/Platform or Tenant of Secret Server Cloud must be set")
+	validationErr := config.Validate()
+	if validationErr != nil && validationErr != errMissingCredentials && validationErr != errMissingEndpoint {
+		return nil, validationErr
 	}
 	if config.TLD == "" {
 		config.TLD = defaultTLD
@@ -86,87 +538,243 @@ func New(config Configuration, opts ...ServerOption) (*Server, error) {
 	for _, opt := range opts {
 		opt(server)
 	}
+	if config.ServerURL == "" && config.Tenant == "" && server.tenantResolver == nil {
+		return nil, errMissingEndpoint
+	}
+	if server.tenantResolver != nil && config.ServerURL != "" {
+		return nil, fmt.Errorf("a tenant resolver cannot be used with a ServerURL")
+	}
+	if validationErr == errMissingCredentials && !server.hasOptionCredentials() {
+		return nil, validationErr
+	}
 
 	if server.httpClient == nil {
 		server.httpClient = &http.Client{}
 	}
 
-	if config.TLSClientConfig != nil {
-		server.httpClient.Transport.(*http.Transport).TLSClientConfig = config.TLSClientConfig
+	if server.roundTripper != nil {
+		client := *server.httpClient
+		client.Transport = server.roundTripper
+		server.httpClient = &client
+	}
+
+	if config.TLSClientConfig != nil || server.dialer != nil {
+		transport := server.httpClient.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		httpTransport, ok := transport.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("TLSClientConfig and WithDialer require the transport to be an *http.Transport, but it is a %T", transport)
+		}
+		// the transport is cloned so that http.DefaultTransport, or one that
+		// is shared with other clients, is left unchanged, and keeps its
+		// proxy settings
+		httpTransport = httpTransport.Clone()
+		if config.TLSClientConfig != nil {
+			httpTransport.TLSClientConfig = config.TLSClientConfig
+		}
+		if server.dialer != nil {
+			httpTransport.DialContext = server.dialer.DialContext
+		}
+
+		client := *server.httpClient
+		client.Transport = httpTransport
+		server.httpClient = &client
 	}
 
 	return server, nil
 }
 
-// urlFor is the URL for the given resource and path
-func (s *Server) urlFor(ctx context.Context, resource, path string) string {
-	var baseURL string
+// hasOptionCredentials reports whether credentials were supplied by an option
+// rather than by the Configuration
+func (s *Server) hasOptionCredentials() bool {
+	return s.clientID != "" || s.sdkClient != nil
+}
 
-	if s.ServerURL == "" {
-		baseURL = fmt.Sprintf(cloudBaseURLTemplate, s.Tenant, s.TLD)
-	} else {
-		baseURL = s.ServerURL
+// Close releases the resources held by the server by closing its idle
+// connections. The cached access token is left in place, since the token cache
+// and a TokenStore are shared with the other Servers of the same credentials.
+// The Server should not be used after calling Close.
+func (s *Server) Close() error {
+	s.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// serverBaseURL is the base URL of the Secret Server, which is derived from
+// the tenant returned by the tenant resolver, when there is one, on each call
+func (s *Server) serverBaseURL(ctx context.Context) (string, error) {
+	if s.ServerURL != "" {
+		return s.ServerURL, nil
+	}
+	if s.tenantResolver == nil {
+		return CloudBaseURL(s.Tenant, s.TLD), nil
+	}
+
+	tenant, tld, err := s.tenantResolver(ctx)
+	if err != nil {
+		s.log(ctx).Error("error resolving the tenant", zap.Error(err))
+		return "", err
+	}
+	if tld == "" {
+		tld = s.TLD
+	}
+	if !tldPattern.MatchString(tld) {
+		return "", fmt.Errorf("invalid resolved TLD '%s'", tld)
+	}
+	if err := validateTenant(tenant, tld); err != nil {
+		return "", fmt.Errorf("resolving the tenant: %w", err)
+	}
+	return CloudBaseURL(tenant, tld), nil
+}
+
+// baseURLFor is the base URL for requests to the given resource, which is the
+// endpoint override for the resource when there is one
+func (s *Server) baseURLFor(ctx context.Context, resource string) (string, error) {
+	if override, found := s.endpointOverrides[resource]; found && override != "" {
+		return override, nil
+	}
+	return s.serverBaseURL(ctx)
+}
+
+// urlFor is the URL for the given resource and path. An empty path is the
+// resource itself, without the trailing slash of a path of "/".
+func (s *Server) urlFor(ctx context.Context, resource, path string) (string, error) {
+	baseURL, err := s.baseURLFor(ctx, resource)
+	if err != nil {
+		return "", err
 	}
 
 	switch {
 	case resource == "token":
 		return fmt.Sprintf("%s/%s",
 			strings.Trim(baseURL, "/"),
-			strings.Trim(s.tokenPathURI, "/"))
+			strings.Trim(s.tokenPathURI, "/")), nil
+	case path == "":
+		return fmt.Sprintf("%s/%s/%s",
+			strings.Trim(baseURL, "/"),
+			strings.Trim(s.apiPathURI, "/"),
+			strings.Trim(resource, "/")), nil
 	default:
 		return fmt.Sprintf("%s/%s/%s/%s",
 			strings.Trim(baseURL, "/"),
 			strings.Trim(s.apiPathURI, "/"),
 			strings.Trim(resource, "/"),
-			strings.Trim(path, "/"))
+			strings.Trim(path, "/")), nil
 	}
 }
 
-func (s *Server) urlForSearch(ctx context.Context, resource, searchText, fieldName string) string {
-	var baseURL string
+// withQuery appends the encoded query, if any, to the resource path
+func withQuery(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
 
-	if s.ServerURL == "" {
-		baseURL = fmt.Sprintf(cloudBaseURLTemplate, s.Tenant, s.TLD)
-	} else {
-		baseURL = s.ServerURL
+func (s *Server) urlForSearch(ctx context.Context, resource, searchText, fieldName string, filters SearchFilters, skip int) (string, error) {
+	baseURL, err := s.baseURLFor(ctx, resource)
+	if err != nil {
+		return "", err
 	}
+
 	switch {
 	case resource == "secrets":
-		url := fmt.Sprintf("%s/%s/%s?paging.filter.searchText=%s&paging.filter.searchField=%s&paging.filter.doNotCalculateTotal=true&paging.take=30&&paging.skip=0",
+		url := fmt.Sprintf("%s/%s/%s?paging.filter.searchText=%s&paging.filter.searchField=%s&paging.filter.doNotCalculateTotal=%t&paging.take=%d&&paging.skip=%d",
 			strings.Trim(baseURL, "/"),
 			strings.Trim(s.apiPathURI, "/"),
 			strings.Trim(resource, "/"),
 			searchText,
-			fieldName)
+			fieldName,
+			!filters.CalculateTotal,
+			filters.pageSize(),
+			skip)
+		if query := filters.query(); len(query) > 0 {
+			url = fmt.Sprintf("%s&%s", url, query.Encode())
+		}
 		if fieldName == "" {
-			return fmt.Sprintf("%s%s", url, "&paging.filter.extendedFields=Machine&paging.filter.extendedFields=Notes&paging.filter.extendedFields=Username")
+			return fmt.Sprintf("%s%s", url, "&paging.filter.extendedFields=Machine&paging.filter.extendedFields=Notes&paging.filter.extendedFields=Username"), nil
 		}
-		return fmt.Sprintf("%s%s", url, "&paging.filter.isExactMatch=true")
+		return fmt.Sprintf("%s%s", url, "&paging.filter.isExactMatch=true"), nil
 	default:
-		return ""
+		return "", nil
+	}
+}
+
+// ResolveURL returns the URL that a request for the given resource and path is
+// sent to, with the endpoint overrides and the ServerURL or Tenant applied, so
+// that callers can log or check the effective endpoint. The tenant resolver,
+// when there is one, is called with a background context.
+func (s *Server) ResolveURL(resource, path string) (string, error) {
+	return s.urlFor(context.Background(), resource, path)
+}
+
+// ResolveSearchURL returns the URL of the first page of a search of the given
+// resource, as made by Secrets, SecretsWithFilters and SearchSecrets
+func (s *Server) ResolveSearchURL(resource, searchText, field string, filters SearchFilters) (string, error) {
+	searchURL, err := s.urlForSearch(context.Background(), resource, searchText, field, filters, 0)
+	if err != nil {
+		return "", err
+	}
+	if searchURL == "" {
+		return "", ErrUnknownResource
 	}
+	return searchURL, nil
 }
 
 // accessResource uses the accessToken to access the API resource.
 // It assumes an appropriate combination of method, resource, path and input.
 func (s *Server) accessResource(ctx context.Context, method, resource, path string, input interface{}) ([]byte, error) {
-	l := ctxzap.Extract(ctx)
+	res, err := s.accessResourceResponse(ctx, method, resource, path, input, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return s.readResponse(ctx, res)
+}
+
+// accessResourceResponse accesses the API resource like accessResource, with
+// the extra request headers, for the callers which need the response itself
+// rather than its body. A 2xx or 304 (Not Modified) response is returned with
+// its body unread, for the caller to read and close; any other response is
+// returned as the error of handleResponse.
+func (s *Server) accessResourceResponse(ctx context.Context, method, resource, path string, input interface{}, header http.Header) (*http.Response, error) {
+	l := s.log(ctx)
 
 	switch resource {
 	case "secrets":
 	case "secret-templates":
+	case "folders":
+	case "users":
+	case "version":
 	default:
-		message := "unknown resource"
-
-		l.Error("error accessing resource", zap.String("message", message), zap.String("resource", resource))
-		return nil, errors.New(message)
+		l.Error("error accessing resource", zap.Error(ErrUnknownResource), zap.String("resource", resource))
+		return nil, ErrUnknownResource
 	}
 
-	body := bytes.NewBuffer([]byte{})
+	return s.accessURL(ctx, method, input, header, func() (string, error) {
+		return s.urlFor(ctx, resource, path)
+	})
+}
+
+// accessURL sends an authenticated API request to the URL returned by
+// resourceURL, which is resolved once the access token is obtained, since
+// obtaining it can discover the URL of the vault of a platform. It retries the
+// request with doRequest and refreshes a rejected static token, returning the
+// response like accessResourceResponse.
+func (s *Server) accessURL(ctx context.Context, method string, input interface{}, header http.Header, resourceURL func() (string, error)) (*http.Response, error) {
+	l := s.log(ctx)
+
+	// the body is a bytes.Reader so that the request sets GetBody, which
+	// doRequest uses to replay the body when a write is retried
+	body := bytes.NewReader([]byte{})
 
 	if input != nil {
 		if data, err := json.Marshal(input); err == nil {
-			body = bytes.NewBuffer(data)
+			body = bytes.NewReader(data)
+			if s.verboseLogging {
+				l.Debug("request body", zap.String("body", maskJSON(data)))
+			}
 		} else {
 			l.Error("error marshaling the request body to JSON", zap.Error(err))
 			return nil, err
@@ -180,20 +788,28 @@ func (s *Server) accessResource(ctx context.Context, method, resource, path stri
 		return nil, err
 	}
 
-	req, err := http.NewRequest(method, s.urlFor(ctx, resource, path), body)
+	requestURL, err := resourceURL()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, body)
 
 	if err != nil {
 		l.Error(
 			"error creating request",
 			zap.String("method", method),
-			zap.String("resource", resource),
-			zap.String("path", path),
+			zap.String("url", requestURL),
 			zap.Error(err),
 		)
 		return nil, err
 	}
 
+	for key, values := range header {
+		req.Header[key] = values
+	}
 	req.Header.Add("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", version.UserAgent())
 
 	switch method {
 	case http.MethodPost, http.MethodPut, http.MethodPatch:
@@ -202,68 +818,145 @@ func (s *Server) accessResource(ctx context.Context, method, resource, path stri
 
 	l.Debug("calling API", zap.String("method", method), zap.String("url", req.URL.String()))
 
-	data, statusCode, err := handleResponse(s.httpClient.Do(req))
+	res, err := s.doRequest(ctx, req)
+
+	// a rejected static token is refreshed, when a refresher is set, and the
+	// request is retried once with the new token
+	if err == nil && res.StatusCode == http.StatusUnauthorized && s.staticTokenRefresher != nil && s.staticToken() != "" {
+		if token, refreshErr := s.refreshStaticToken(ctx, accessToken); refreshErr == nil {
+			retry := req.Clone(ctx)
+			if req.GetBody != nil {
+				if retry.Body, err = req.GetBody(); err != nil {
+					res.Body.Close()
+					return nil, err
+				}
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			retry.Header.Set("Authorization", "Bearer "+token)
+			l.Debug("retrying the request with the refreshed static token", zap.String("method", method), zap.String("url", req.URL.String()))
+			res, err = s.doRequest(ctx, retry)
+		} else {
+			l.Error("error refreshing the static token", zap.Error(refreshErr))
+		}
+	}
 
-	// Check for unauthorized or access denied
-	if statusCode.StatusCode == http.StatusUnauthorized || statusCode.StatusCode == http.StatusForbidden {
-		s.clearTokenCache(ctx)
-		l.Error("token cache cleared due to unauthorized or access denied response")
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode > 199 && res.StatusCode < 300 || res.StatusCode == http.StatusNotModified {
+		return res, nil
+	}
+	_, _, err = handleResponse(res, nil)
+	res.Body.Close()
+
+	// Check for unauthorized or access denied, but leave the token alone when
+	// the 403 only means the secret requires a comment to be accessed or is
+	// checked out by another user, or the server is in maintenance mode
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		if errors.Is(err, ErrMaintenanceMode) {
+			l.Error("the server is in maintenance mode", zap.String("url", requestURL))
+		} else if res.StatusCode == http.StatusForbidden && isCommentRequired(err) {
+			l.Error("access denied because a comment is required", zap.String("url", requestURL))
+		} else if res.StatusCode == http.StatusForbidden && errors.Is(err, ErrCheckedOut) {
+			l.Error("access denied because the secret is checked out", zap.String("url", requestURL), zap.Error(err))
+		} else {
+			s.clearTokenCache(ctx)
+			l.Error("token cache cleared due to unauthorized or access denied response")
+		}
 	}
 
+	return nil, err
+}
+
+// readResponse reads the body of a response of accessResourceResponse with
+// handleResponse, logging it when verbose logging is enabled
+func (s *Server) readResponse(ctx context.Context, res *http.Response) ([]byte, error) {
+	data, _, err := handleResponse(res, nil)
+	if s.verboseLogging && err == nil {
+		s.log(ctx).Debug("response body", zap.String("body", maskJSON(data)))
+	}
 	return data, err
 }
 
-// searchResources uses the accessToken to search for API resources.
+// commentRequiredMarkers are the (lowercased) fragments of a 403 error body
+// which indicate that the secret requires a comment rather than that the
+// access token was rejected
+var commentRequiredMarkers = []string{"commentrequired", "comment is required", "comment required"}
+
+// isCommentRequired reports whether the error returned by handleResponse
+// carries the Secret Server "comment required" error body
+func isCommentRequired(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	for _, marker := range commentRequiredMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchResources uses the accessToken to search for API resources, sending
+// the search like accessResource.
 // It assumes an appropriate combination of resource, search text.
-// field is optional
-func (s *Server) searchResources(ctx context.Context, resource, searchText, field string) ([]byte, error) {
-	l := ctxzap.Extract(ctx)
+// field and filters are optional, skip is the number of records to page past
+func (s *Server) searchResources(ctx context.Context, resource, searchText, field string, filters SearchFilters, skip int) ([]byte, error) {
+	l := s.log(ctx)
 
 	switch resource {
 	case "secrets":
 	default:
-		message := "unknown resource"
-		l.Error("error searching resources", zap.String("message", message), zap.String("resource", resource))
-		return nil, fmt.Errorf(message)
+		l.Error("error searching resources", zap.Error(ErrUnknownResource), zap.String("resource", resource))
+		return nil, ErrUnknownResource
 	}
 
-	method := "GET"
-	body := bytes.NewBuffer([]byte{})
-
-	accessToken, err := s.getAccessToken(ctx)
-
+	res, err := s.accessURL(ctx, http.MethodGet, nil, nil, func() (string, error) {
+		return s.urlForSearch(ctx, resource, searchText, field, filters, skip)
+	})
 	if err != nil {
-		l.Error("error getting accessToken", zap.Error(err))
 		return nil, err
 	}
+	defer res.Body.Close()
+	return s.readResponse(ctx, res)
+}
 
-	req, err := http.NewRequest(method, s.urlForSearch(ctx, resource, searchText, field), body)
+// resultPage is a page of a paged listing of the API
+type resultPage interface {
+	// paging returns the NextSkip and HasNext of the page, and the number of
+	// records on it
+	paging() (nextSkip int, hasNext bool, records int)
+}
 
-	if err != nil {
-		l.Error(
-			"error creating search request",
-			zap.String("method", method),
-			zap.String("resource", resource),
-			zap.String("searchText", searchText),
-			zap.String("field", field),
-			zap.Error(err),
-		)
-		return nil, err
+// eachPage pages through a paged listing, calling fetch with the skip of each
+// page, from the first, until a page has no next one or no records, or fetch
+// returns an error or a nil page. The next page starts at the NextSkip of the
+// server, or past the records of the page when NextSkip does not move forward.
+func eachPage(fetch func(skip int) (resultPage, error)) error {
+	skip := 0
+	for {
+		page, err := fetch(skip)
+		if err != nil || page == nil {
+			return err
+		}
+		nextSkip, hasNext, records := page.paging()
+		if !hasNext || records == 0 {
+			return nil
+		}
+		if nextSkip > skip {
+			skip = nextSkip
+		} else {
+			skip += records
+		}
 	}
-
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-
-	l.Debug("calling API", zap.String("method", method), zap.String("url", req.URL.String()))
-
-	data, _, err := handleResponse(s.httpClient.Do(req))
-
-	return data, err
 }
 
 // uploadFile uploads the file described in the given fileField to the
 // secret at the given secretId as a multipart/form-data request.
-func (s *Server) uploadFile(ctx context.Context, secretId int, fileField SecretField) error {
-	l := ctxzap.Extract(ctx)
+func (s *Server) uploadFile(ctx context.Context, secretId int, fileField SecretField, filename string) error {
+	l := s.log(ctx)
 
 	l.Debug("uploading a file to the field", zap.String("slug", fileField.Slug), zap.String("filename", fileField.Filename))
 	body := bytes.NewBuffer([]byte{})
@@ -278,8 +971,9 @@ func (s *Server) uploadFile(ctx context.Context, secretId int, fileField SecretF
 
 	// Create the multipart form
 	multipartWriter := multipart.NewWriter(body)
-	filename := fileField.Filename
-	if filename == "" {
+	if filename != "" {
+		l.Debug("uploading the file with the given filename", zap.String("filename", filename))
+	} else if filename = fileField.Filename; filename == "" {
 		filename = "File.txt"
 		l.Debug("field has no filename, setting its filename", zap.String("filename", filename))
 	} else if match, _ := regexp.Match("[^.]+\\.\\w+$", []byte(filename)); !match {
@@ -300,15 +994,20 @@ func (s *Server) uploadFile(ctx context.Context, secretId int, fileField SecretF
 	}
 
 	// Make the request
-	req, err := http.NewRequest(http.MethodPut, s.urlFor(ctx, resource, uploadPath), body)
+	uploadURL, err := s.urlFor(ctx, resource, uploadPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, body)
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", version.UserAgent())
 	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
 
 	l.Debug("uploading file with PUT", zap.String("url", req.URL.String()))
-	_, _, err = handleResponse(s.httpClient.Do(req))
+	_, _, err = handleResponse(s.httpClient.Do(s.withHTTPTrace(req)))
 	if err != nil {
 		return err
 	}
@@ -316,57 +1015,154 @@ func (s *Server) uploadFile(ctx context.Context, secretId int, fileField SecretF
 	return nil
 }
 
+// tokenCacheMu serializes the access to the token cache, which is shared by
+// every Server of the process through the environment, so that concurrent
+// writers cannot interleave with readers
+var tokenCacheMu sync.Mutex
+
 func (s *Server) setCacheAccessToken(ctx context.Context, value string, expiresIn int, baseURL string) error {
+	if s.disableTokenCache {
+		return nil
+	}
 	cache := TokenCache{}
 	cache.AccessToken = value
 	cache.ExpiresIn = (int(time.Now().Unix()) + expiresIn) - int(math.Floor(float64(expiresIn)*0.9))
 
+	if s.tokenStore != nil {
+		return s.tokenStore.Store(ctx, s.tokenStoreKey(baseURL), value, time.Unix(int64(cache.ExpiresIn), 0))
+	}
 	data, _ := json.Marshal(cache)
+
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
 	os.Setenv("SS_AT_"+url.QueryEscape(baseURL), string(data))
 	return nil
 }
 
+// tokenStoreKey is the key of the access token of the Server in its
+// TokenStore: the baseURL and the principal the token is granted to, so that
+// Servers sharing a store never use the tokens of other users or clients
+func (s *Server) tokenStoreKey(baseURL string) string {
+	var principal string
+	switch {
+	case s.sdkClient != nil:
+		// the client ID of an SDK client is only known once it is registered
+		principal = "sdk-client:" + s.sdkClient.clientName
+	case s.clientID != "":
+		principal = "client:" + s.clientID
+	case s.Credentials.Domain != "":
+		principal = "user:" + s.Credentials.Domain + "\\" + s.Credentials.Username
+	default:
+		principal = "user:" + s.Credentials.Username
+	}
+	return baseURL + "|" + principal
+}
+
 func (s *Server) getCacheAccessToken(ctx context.Context, baseURL string) (string, bool) {
+	token, _, found := s.cachedAccessToken(ctx, baseURL)
+	return token, found
+}
+
+// cachedAccessToken returns the unexpired token cached for the baseURL, with
+// the time at which it expires
+func (s *Server) cachedAccessToken(ctx context.Context, baseURL string) (string, time.Time, bool) {
+	if s.disableTokenCache {
+		return "", time.Time{}, false
+	}
+	if s.tokenStore != nil {
+		token, expiresAt, ok := s.tokenStore.Load(ctx, s.tokenStoreKey(baseURL))
+		if !ok || !time.Now().Before(expiresAt) {
+			return "", time.Time{}, false
+		}
+		return token, expiresAt, true
+	}
+	tokenCacheMu.Lock()
 	data, ok := os.LookupEnv("SS_AT_" + url.QueryEscape(baseURL))
+	tokenCacheMu.Unlock()
 	if !ok {
 		s.clearTokenCache(ctx)
-		return "", ok
+		return "", time.Time{}, ok
 	}
 	cache := TokenCache{}
 	if err := json.Unmarshal([]byte(data), &cache); err != nil {
-		return "", false
+		return "", time.Time{}, false
 	}
 	if time.Now().Unix() < int64(cache.ExpiresIn) {
-		return cache.AccessToken, true
+		return cache.AccessToken, time.Unix(int64(cache.ExpiresIn), 0), true
 	}
-	return "", false
+	return "", time.Time{}, false
 }
 
 func (s *Server) clearTokenCache(ctx context.Context) {
-	var baseURL string
-
-	if s.ServerURL == "" {
-		baseURL = fmt.Sprintf(cloudBaseURLTemplate, s.Tenant, s.TLD)
-	} else {
-		baseURL = s.ServerURL
+	if s.disableTokenCache {
+		return
+	}
+	baseURL, err := s.serverBaseURL(ctx)
+	if err != nil {
+		return
+	}
+	if s.tokenStore != nil {
+		s.tokenStore.Delete(ctx, s.tokenStoreKey(baseURL))
+		return
 	}
 
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
 	os.Setenv("SS_AT_"+url.QueryEscape(baseURL), "")
 }
 
+// grantValues returns the form values of the token grant request, which is the
+// client_credentials grant when client credentials are configured and the
+// password grant otherwise
+func (s *Server) grantValues() url.Values {
+	if s.clientID != "" {
+		return url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {s.clientID},
+			"client_secret": {s.clientSecret},
+		}
+	}
+	return s.passwordGrantValues()
+}
+
+// passwordGrantValues returns the form values of the password grant request,
+// formatting the username and domain according to the usernameFormat
+func (s *Server) passwordGrantValues() url.Values {
+	username := s.Credentials.Username
+	domain := s.Credentials.Domain
+
+	values := url.Values{
+		"password":   {s.Credentials.Password},
+		"grant_type": {"password"},
+	}
+
+	switch {
+	case domain == "":
+	case s.usernameFormat == UsernameFormatUPN:
+		username = username + "@" + domain
+	case s.usernameFormat == UsernameFormatDownLevel:
+		username = domain + "\\" + username
+	default:
+		values.Set("domain", domain)
+	}
+	values.Set("username", username)
+
+	return values
+}
+
 // getAccessToken gets an OAuth2 Access Grant and returns the token
 // endpoint and get an accessGrant.
 func (s *Server) getAccessToken(ctx context.Context) (string, error) {
-	l := ctxzap.Extract(ctx)
-	if s.Credentials.Token != "" {
-		return s.Credentials.Token, nil
+	l := s.log(ctx)
+	if token := s.staticToken(); token != "" {
+		return token, nil
 	}
-	var baseURL string
 
-	if s.ServerURL == "" {
-		baseURL = fmt.Sprintf(cloudBaseURLTemplate, s.Tenant, s.TLD)
-	} else {
-		baseURL = s.ServerURL
+	// the base URL is resolved on each call, so that the cached tokens of
+	// each tenant are kept apart
+	baseURL, err := s.serverBaseURL(ctx)
+	if err != nil {
+		return "", err
 	}
 
 	response, err := s.checkPlatformDetails(ctx, baseURL)
@@ -380,36 +1176,43 @@ func (s *Server) getAccessToken(ctx context.Context) (string, error) {
 			return accessToken, nil
 		}
 
-		values := url.Values{
-			"username":   {s.Credentials.Username},
-			"password":   {s.Credentials.Password},
-			"grant_type": {"password"},
-		}
-		if s.Credentials.Domain != "" {
-			values["domain"] = []string{s.Credentials.Domain}
+		if s.sdkClient != nil {
+			if err := s.registerSDKClient(ctx); err != nil {
+				return "", err
+			}
 		}
 
-		body := strings.NewReader(values.Encode())
-		requestUrl := s.urlFor(ctx, "token", "")
-		data, _, err := handleResponse(http.Post(requestUrl, "application/x-www-form-urlencoded", body))
+		requestUrl, err := s.urlFor(ctx, "token", "")
+		if err != nil {
+			return "", err
+		}
+		values := s.grantValues()
+		data, res, err := s.postTokenRequest(ctx, s.httpClient, requestUrl, values)
+
+		// answer a multi-factor challenge by resubmitting the grant with a
+		// one-time password from the configured provider
+		if errors.Is(err, ErrMFARequired) && s.otpProvider != nil {
+			l.Debug("the token grant requires a one-time password, resubmitting")
+			otp, otpErr := s.otpProvider(ctx)
+			if otpErr != nil {
+				l.Error("error getting a one-time password", zap.Error(otpErr))
+				return "", otpErr
+			}
+			values.Set("otp", otp)
+			data, res, err = s.postTokenRequest(ctx, s.httpClient, requestUrl, values)
+		}
 
 		if err != nil {
 			l.Error("Error while getting token response:", zap.Error(err))
 			return "", err
 		}
 
-		grant := struct {
-			AccessToken  string `json:"access_token"`
-			RefreshToken string `json:"refresh_token"`
-			TokenType    string `json:"token_type"`
-			ExpiresIn    int    `json:"expires_in"`
-		}{}
-
-		if err = json.Unmarshal(data, &grant); err != nil {
+		grant, err := parseTokenResponse(res, data)
+		if err != nil {
 			l.Error("error parsing grant response", zap.Error(err))
 			return "", err
 		}
-		if err = s.setCacheAccessToken(ctx, grant.AccessToken, grant.ExpiresIn, baseURL); err != nil {
+		if err = s.setCacheAccessToken(ctx, grant.AccessToken, tokenLifetime(s.logContext(ctx), res, grant), baseURL); err != nil {
 			l.Error("error caching access token", zap.Error(err))
 			return "", err
 		}
@@ -420,16 +1223,16 @@ func (s *Server) getAccessToken(ctx context.Context) (string, error) {
 }
 
 func (s *Server) checkPlatformDetails(ctx context.Context, baseURL string) (string, error) {
-	l := ctxzap.Extract(ctx)
+	l := s.log(ctx)
 
 	platformHelthCheckUrl := fmt.Sprintf("%s/%s", strings.Trim(baseURL, "/"), "health")
 	ssHealthCheckUrl := fmt.Sprintf("%s/%s", strings.Trim(baseURL, "/"), "healthcheck.aspx")
 
-	isHealthy := checkJSONResponse(ctx, ssHealthCheckUrl)
+	isHealthy, ssErr := s.checkJSONResponse(ctx, ssHealthCheckUrl)
 	if isHealthy {
 		return "", nil
 	} else {
-		isHealthy := checkJSONResponse(ctx, platformHelthCheckUrl)
+		isHealthy, platformErr := s.checkJSONResponse(ctx, platformHelthCheckUrl)
 		if isHealthy {
 
 			accessToken, found := s.getCacheAccessToken(ctx, baseURL)
@@ -440,41 +1243,29 @@ func (s *Server) checkPlatformDetails(ctx context.Context, baseURL string) (stri
 				requestData.Set("client_secret", s.Credentials.Password)
 				requestData.Set("scope", "xpmheadless")
 
-				req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s", strings.Trim(baseURL, "/"), "identity/api/oauth2/token/xpmplatform"), bytes.NewBufferString(requestData.Encode()))
-				if err != nil {
-					l.Error("error creating HTTP request", zap.Error(err))
-					return "", err
-				}
-
-				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-				data, _, err := handleResponse((&http.Client{}).Do(req))
+				tokenURL := fmt.Sprintf("%s/%s", strings.Trim(baseURL, "/"), "identity/api/oauth2/token/xpmplatform")
+				data, res, err := s.postTokenRequest(ctx, s.httpClient, tokenURL, requestData)
 				if err != nil {
 					l.Error("error while getting token response:", zap.Error(err))
 					return "", err
 				}
 
-				var tokenjsonResponse OAuthTokens
-				if err = json.Unmarshal(data, &tokenjsonResponse); err != nil {
+				tokenjsonResponse, err := parseTokenResponse(res, data)
+				if err != nil {
 					l.Error("error parsing get token response:", zap.Error(err))
 					return "", err
 				}
 				accessToken = tokenjsonResponse.AccessToken
 
-				if err = s.setCacheAccessToken(ctx, tokenjsonResponse.AccessToken, tokenjsonResponse.ExpiresIn, baseURL); err != nil {
+				if err = s.setCacheAccessToken(ctx, tokenjsonResponse.AccessToken, tokenLifetime(s.logContext(ctx), res, tokenjsonResponse), baseURL); err != nil {
 					l.Error("error caching access token:", zap.Error(err))
 					return "", err
 				}
 			}
 
-			req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", strings.Trim(baseURL, "/"), "vaultbroker/api/vaults"), bytes.NewBuffer([]byte{}))
-			if err != nil {
-				l.Error("error creating HTTP request:", zap.Error(err))
-				return "", err
-			}
-			req.Header.Add("Authorization", "Bearer "+accessToken)
-
-			data, _, err := handleResponse(s.httpClient.Do(req))
+			// the platform token is kept, and only the vaults request is
+			// retried, so that a transient failure does not re-authenticate
+			data, err := s.getVaults(ctx, baseURL, accessToken)
 			if err != nil {
 				l.Error("error while getting vaults response:", zap.Error(err))
 				return "", err
@@ -501,33 +1292,97 @@ func (s *Server) checkPlatformDetails(ctx context.Context, baseURL string) (stri
 
 			return accessToken, nil
 		}
+
+		// neither health check succeeded, so report why each failed rather
+		// than just that the URL is invalid
+		err := fmt.Errorf("invalid URL %s: neither the Secret Server nor the Platform health check succeeded: %w",
+			baseURL, errors.Join(ssErr, platformErr))
+		l.Error("error detecting the platform", zap.Error(err))
+		return "", err
+	}
+}
+
+// getVaults gets the vaults list of the platform at baseURL with the platform
+// access token. Failures which IsRetryable classifies as retryable, and any
+// 5xx response, since the gateways in front of a platform commonly answer 502
+// or 504 while it starts, are retried with the backoff of the Server, up to
+// tokenMaxAttempts times in all.
+func (s *Server) getVaults(ctx context.Context, baseURL, accessToken string) ([]byte, error) {
+	l := s.log(ctx)
+	vaultsURL := fmt.Sprintf("%s/%s", strings.Trim(baseURL, "/"), "vaultbroker/api/vaults")
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, vaultsURL, nil)
+		if err != nil {
+			l.Error("error creating HTTP request:", zap.Error(err))
+			return nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+		req.Header.Set("User-Agent", version.UserAgent())
+
+		res, err := s.httpClient.Do(s.withHTTPTrace(req))
+		serverError := err == nil && res.StatusCode >= http.StatusInternalServerError
+		if attempt >= tokenMaxAttempts || !serverError && !retryable(res, err) {
+			data, _, err := handleResponse(res, err)
+			if res != nil {
+				res.Body.Close()
+			}
+			return data, err
+		}
+
+		delay := attemptDelay(res, attempt, s.retryBackoff())
+		l.Debug("vaults request failed, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
 	}
-	return "", fmt.Errorf("invalid URL")
 }
 
-func checkJSONResponse(ctx context.Context, url string) bool {
-	l := ctxzap.Extract(ctx)
+// checkJSONResponse reports whether the health check at url reports healthy,
+// along with the reason when it does not: the request or read error, or the
+// status of the response
+func (s *Server) checkJSONResponse(ctx context.Context, url string) (bool, error) {
+	l := s.log(ctx)
 
-	response, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		l.Error("error creating health check request", zap.Error(err))
+		return false, fmt.Errorf("health check %s: %w", url, err)
+	}
+	req.Header.Set("User-Agent", version.UserAgent())
+
+	// the client of the Server is used so that its transport, dialer and TLS
+	// configuration also apply to the health checks
+	response, err := s.httpClient.Do(s.withHTTPTrace(req))
 	if err != nil {
 		l.Error("error making GET request", zap.Error(err))
-		return false
+		return false, fmt.Errorf("health check %s: %w", url, err)
 	}
 	defer response.Body.Close()
 
 	body, err := io.ReadAll(response.Body)
 	if err != nil {
 		l.Error("error reading response body", zap.Error(err))
-		return false
+		return false, fmt.Errorf("health check %s: reading the response: %w", url, err)
 	}
 
+	var healthy bool
 	var jsonResponse Response
-	err = json.Unmarshal(body, &jsonResponse)
-	if err == nil {
-		return jsonResponse.Healthy
+	if err = json.Unmarshal(body, &jsonResponse); err == nil {
+		healthy = jsonResponse.Healthy
 	} else {
-		return strings.Contains(string(body), "Healthy")
+		healthy = strings.Contains(string(body), "Healthy")
+	}
+	if !healthy {
+		return false, fmt.Errorf("health check %s: not healthy (%s)", url, response.Status)
 	}
+	return true, nil
 }
 
 type Response struct {
@@ -0,0 +1,984 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestServer starts an httptest server backed by the given handler and
+// returns a Server configured to use it with password credentials. The server
+// answers the Secret Server health check and the token grant itself so that
+// getAccessToken takes the password grant path.
+func newTestServer(t *testing.T, handler http.Handler, opts ...ServerOption) (*Server, *httptest.Server) {
+	return newTestServerWithToken(t, http.HandlerFunc(grantTestToken), handler, opts...)
+}
+
+// newTestServerWithToken is newTestServer with the token grant answered by the
+// given tokenHandler.
+func newTestServerWithToken(t *testing.T, tokenHandler, handler http.Handler, opts ...ServerOption) (*Server, *httptest.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthcheck.aspx", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"healthy": true}`))
+	})
+	mux.Handle("/oauth2/token", tokenHandler)
+	mux.Handle("/", handler)
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	tss, err := New(Configuration{
+		Credentials: UserCredential{
+			Username: "test_user",
+			Password: "test_password",
+		},
+		ServerURL: ts.URL,
+	}, opts...)
+	if err != nil {
+		t.Fatal("configuring the test Server:", err)
+	}
+	t.Cleanup(func() { tss.clearTokenCache(context.Background()) })
+
+	return tss, ts
+}
+
+// mustURL returns a function which fails the test when building a URL failed
+func mustURL(t *testing.T) func(string, error) string {
+	return func(u string, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal("building the URL:", err)
+		}
+		return u
+	}
+}
+
+// grantTestToken answers a token grant with a fixed access token.
+func grantTestToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"access_token": "test_token", "token_type": "bearer", "expires_in": 1200}`))
+}
+
+// TestAccessResourceCommentRequired asserts that a "comment required" 403 does
+// not clear the token cache while a genuine access denied 403 does.
+func TestAccessResourceCommentRequired(t *testing.T) {
+	ctx := context.Background()
+
+	tss, ts := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		if r.URL.Path == "/api/v1/secrets/1" {
+			w.Write([]byte(`{"errorCode": "API_CommentRequired", "message": "Comment is required."}`))
+		} else {
+			w.Write([]byte(`{"message": "Access Denied"}`))
+		}
+	}))
+
+	if err := tss.setCacheAccessToken(ctx, "cached_token", 3600, ts.URL); err != nil {
+		t.Fatal("seeding the token cache:", err)
+	}
+
+	if _, err := tss.Secret(ctx, 1); err == nil {
+		t.Error("expected an error reading a secret that requires a comment")
+	}
+	if token, found := tss.getCacheAccessToken(ctx, ts.URL); !found || token != "cached_token" {
+		t.Errorf("expected the token cache to survive a comment required response, found '%s' (%t)", token, found)
+	}
+
+	if _, err := tss.Secret(ctx, 2); err == nil {
+		t.Error("expected an error reading a secret with access denied")
+	}
+	if _, found := tss.getCacheAccessToken(ctx, ts.URL); found {
+		t.Error("expected the token cache to be cleared by an access denied response")
+	}
+}
+
+// TestAccessResourceCheckedOut asserts that a secret which is checked out by
+// another user is reported as a CheckedOutError with the holding user, and
+// that it does not clear the token cache.
+func TestAccessResourceCheckedOut(t *testing.T) {
+	ctx := context.Background()
+
+	tss, ts := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{
+			"errorCode": "API_SecretCheckedOutByOtherUser",
+			"message": "The secret is checked out by another user.",
+			"checkOutUserDisplayName": "Jane Admin",
+			"checkOutMinutesRemaining": 25
+		}`))
+	}))
+
+	if err := tss.setCacheAccessToken(ctx, "cached_token", 3600, ts.URL); err != nil {
+		t.Fatal("seeding the token cache:", err)
+	}
+
+	_, err := tss.Secret(ctx, 1)
+	if !errors.Is(err, ErrCheckedOut) {
+		t.Fatalf("expected ErrCheckedOut, but got '%v'", err)
+	}
+	var checkedOutErr *CheckedOutError
+	if !errors.As(err, &checkedOutErr) {
+		t.Fatalf("expected a CheckedOutError, but got %T", err)
+	}
+	validate("holding user", "Jane Admin", checkedOutErr.User, t)
+	validate("minutes remaining", 25, checkedOutErr.MinutesRemaining, t)
+	validate("status code", http.StatusForbidden, checkedOutErr.StatusCode, t)
+
+	if token, found := tss.getCacheAccessToken(ctx, ts.URL); !found || token != "cached_token" {
+		t.Errorf("expected the token cache to survive a checked out response, found '%s' (%t)", token, found)
+	}
+}
+
+// TestAccessResourceNotCheckedOut asserts that an error which reports that the
+// secret is not checked out, or which is not a 403, is not a CheckedOutError.
+func TestAccessResourceNotCheckedOut(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"check in refused", http.StatusForbidden, `{"errorCode": "API_SecretNotCheckedOut", "message": "The secret is not checked out."}`},
+		{"bad request", http.StatusBadRequest, `{"errorCode": "API_InvalidRequest", "message": "A checked out secret cannot be moved."}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+
+			_, err := tss.Secret(context.Background(), 1)
+			if err == nil || errors.Is(err, ErrCheckedOut) {
+				t.Errorf("expected an error other than ErrCheckedOut, but got '%v'", err)
+			}
+		})
+	}
+}
+
+// TestAccessResourceMaintenanceMode asserts that a maintenance page is returned
+// as ErrMaintenanceMode, whether it is served as a 503 or a 401, and that it
+// does not clear the token cache.
+func TestAccessResourceMaintenanceMode(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusUnauthorized} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			ctx := context.Background()
+			tss, ts := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(status)
+				w.Write([]byte(`<html><body><h1>Secret Server is currently in Maintenance Mode</h1></body></html>`))
+			}))
+
+			if err := tss.setCacheAccessToken(ctx, "cached_token", 3600, ts.URL); err != nil {
+				t.Fatal("seeding the token cache:", err)
+			}
+
+			if _, err := tss.Secret(ctx, 1); !errors.Is(err, ErrMaintenanceMode) {
+				t.Errorf("expected ErrMaintenanceMode, but got '%v'", err)
+			}
+			if token, found := tss.getCacheAccessToken(ctx, ts.URL); !found || token != "cached_token" {
+				t.Errorf("expected the token cache to survive a maintenance mode response, found '%s' (%t)", token, found)
+			}
+		})
+	}
+}
+
+// TestAccessResourceMaintenanceSetting asserts that a JSON client error which
+// mentions maintenance is not mistaken for a maintenance page.
+func TestAccessResourceMaintenanceSetting(t *testing.T) {
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "The secret cannot be changed while the site is in maintenance mode."}`))
+	}))
+
+	_, err := tss.Secret(context.Background(), 1)
+	if errors.Is(err, ErrMaintenanceMode) {
+		t.Fatalf("expected a 400 mentioning maintenance not to be ErrMaintenanceMode, but got '%v'", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a StatusError, but got '%v'", err)
+	}
+	validate("status code", http.StatusBadRequest, statusErr.StatusCode, t)
+}
+
+// TestResolveURL asserts that ResolveURL and ResolveSearchURL return the
+// endpoints of both the tenant and the server URL configurations.
+func TestResolveURL(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		config        Configuration
+		secretURL     string
+		searchURLBase string
+	}{
+		{
+			name:          "tenant",
+			config:        Configuration{Credentials: UserCredential{Token: "static_token"}, Tenant: "example", TLD: "eu"},
+			secretURL:     "https://example.secretservercloud.eu/api/v1/secrets/42",
+			searchURLBase: "https://example.secretservercloud.eu/api/v1/secrets?",
+		},
+		{
+			name:          "server URL",
+			config:        Configuration{Credentials: UserCredential{Token: "static_token"}, ServerURL: "https://example.local/SecretServer/"},
+			secretURL:     "https://example.local/SecretServer/api/v1/secrets/42",
+			searchURLBase: "https://example.local/SecretServer/api/v1/secrets?",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tss, err := New(test.config)
+			if err != nil {
+				t.Fatal("configuring the Server:", err)
+			}
+
+			secretURL, err := tss.ResolveURL("secrets", "42")
+			if err != nil {
+				t.Fatal("calling server.ResolveURL:", err)
+			}
+			validate("secret URL", test.secretURL, secretURL, t)
+
+			searchURL, err := tss.ResolveSearchURL("secrets", "db", "username", SearchFilters{})
+			if err != nil {
+				t.Fatal("calling server.ResolveSearchURL:", err)
+			}
+			if !strings.HasPrefix(searchURL, test.searchURLBase) {
+				t.Errorf("expected the search URL to start with '%s', but found '%s'", test.searchURLBase, searchURL)
+			}
+			parsed, err := url.Parse(searchURL)
+			if err != nil {
+				t.Fatal("parsing the search URL:", err)
+			}
+			query := parsed.Query()
+			validate("search text", "db", query.Get("paging.filter.searchText"), t)
+			validate("search field", "username", query.Get("paging.filter.searchField"), t)
+
+			if _, err := tss.ResolveSearchURL("folders", "db", "", SearchFilters{}); !errors.Is(err, ErrUnknownResource) {
+				t.Errorf("expected ErrUnknownResource for a resource which cannot be searched, but got '%v'", err)
+			}
+		})
+	}
+}
+
+// TestCloudBaseURL asserts that CloudBaseURL defaults the TLD and matches the
+// base URL of a Server configured with the same Tenant and TLD.
+func TestCloudBaseURL(t *testing.T) {
+	validate("default TLD", "https://example.secretservercloud.com/", CloudBaseURL("example", ""), t)
+	validate("overridden TLD", "https://example.secretservercloud.eu/", CloudBaseURL("example", "eu"), t)
+	validate("dotted TLD", "https://example.secretservercloud.com.au/", CloudBaseURL("example", ".com.au"), t)
+
+	tss, err := New(Configuration{Credentials: UserCredential{Token: "static_token"}, Tenant: "example", TLD: "eu"})
+	if err != nil {
+		t.Fatal("configuring the Server:", err)
+	}
+	baseURL, err := tss.serverBaseURL(context.Background())
+	if err != nil {
+		t.Fatal("getting the base URL of the Server:", err)
+	}
+	validate("server base URL", CloudBaseURL("example", "eu"), baseURL, t)
+}
+
+// TestUrlForSearchFilters asserts that each search filter renders into the
+// paging.filter namespace and that unset filters are omitted.
+func TestUrlForSearchFilters(t *testing.T) {
+	ctx := context.Background()
+	tss, err := New(Configuration{
+		Credentials: UserCredential{Token: "static_token"},
+		ServerURL:   "https://example.local/SecretServer",
+	})
+	if err != nil {
+		t.Fatal("configuring the Server:", err)
+	}
+
+	filterParams := []string{
+		"paging.filter.folderId",
+		"paging.filter.includeSubFolders",
+		"paging.filter.secretTemplateIds",
+		"paging.filter.includeInactive",
+		"paging.filter.heartbeatStatus",
+		"paging.filter.lastModifiedDate",
+	}
+
+	unfiltered := mustURL(t)(tss.urlForSearch(ctx, "secrets", "text", "", SearchFilters{}, 0))
+	for _, param := range filterParams {
+		if strings.Contains(unfiltered, param) {
+			t.Errorf("expected '%s' to be omitted from '%s'", param, unfiltered)
+		}
+	}
+	if !strings.Contains(unfiltered, "paging.take=30&") {
+		t.Errorf("expected the default take in '%s'", unfiltered)
+	}
+	if !strings.Contains(unfiltered, "paging.filter.doNotCalculateTotal=true") {
+		t.Errorf("expected the total not to be calculated by default in '%s'", unfiltered)
+	}
+
+	tests := []struct {
+		name     string
+		filters  SearchFilters
+		expected []string
+	}{
+		{"FolderID", SearchFilters{FolderID: 7}, []string{"paging.filter.folderId=7"}},
+		{"IncludeSubFolders", SearchFilters{IncludeSubFolders: true}, []string{"paging.filter.includeSubFolders=true"}},
+		{"TemplateIDs", SearchFilters{TemplateIDs: []int{6, 8}}, []string{"paging.filter.secretTemplateIds=6", "paging.filter.secretTemplateIds=8"}},
+		{"IncludeInactive", SearchFilters{IncludeInactive: true}, []string{"paging.filter.includeInactive=true"}},
+		{"HeartbeatStatus", SearchFilters{HeartbeatStatus: "Failed"}, []string{"paging.filter.heartbeatStatus=Failed"}},
+		{"CalculateTotal", SearchFilters{CalculateTotal: true}, []string{"paging.filter.doNotCalculateTotal=false"}},
+		{"Take", SearchFilters{Take: 100}, []string{"paging.take=100&"}},
+		{"Take above the maximum", SearchFilters{Take: 5000}, []string{"paging.take=500&"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			searchURL := mustURL(t)(tss.urlForSearch(ctx, "secrets", "text", "username", tt.filters, 0))
+			for _, expected := range tt.expected {
+				if !strings.Contains(searchURL, expected) {
+					t.Errorf("expected '%s' in '%s'", expected, searchURL)
+				}
+			}
+			if !strings.HasSuffix(searchURL, "&paging.filter.isExactMatch=true") {
+				t.Errorf("expected the field search to stay exact in '%s'", searchURL)
+			}
+		})
+	}
+}
+
+// TestClose asserts that Close closes idle connections without leaking the
+// transport's connection goroutines.
+func TestClose(t *testing.T) {
+	var closed int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret"}`))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	tss, err := New(Configuration{
+		Credentials: UserCredential{Token: "static_token"},
+		ServerURL:   ts.URL,
+	}, WithHttpClient(&http.Client{Transport: &http.Transport{}}))
+	if err != nil {
+		t.Fatal("configuring the Server:", err)
+	}
+	if _, err := tss.Secret(context.Background(), 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+
+	if err := tss.Close(); err != nil {
+		t.Fatal("calling server.Close:", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&closed) == 0 || runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected idle connections to be closed (%d closed) and goroutines to return to %d, but found %d",
+				atomic.LoadInt32(&closed), goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestCloseKeepsTokenCache asserts that closing a Server leaves the cached
+// token, which other Servers of the same credentials rely on, in place.
+func TestCloseKeepsTokenCache(t *testing.T) {
+	ctx := context.Background()
+	tss, ts := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	if err := tss.setCacheAccessToken(ctx, "cached_token", 3600, ts.URL); err != nil {
+		t.Fatal("seeding the token cache:", err)
+	}
+
+	if err := tss.Close(); err != nil {
+		t.Fatal("calling server.Close:", err)
+	}
+	if token, found := tss.getCacheAccessToken(ctx, ts.URL); !found || token != "cached_token" {
+		t.Errorf("expected the token cache to survive Close, found '%s' (%t)", token, found)
+	}
+}
+
+// TestPasswordGrantValues asserts that each UsernameFormat produces the
+// expected password grant form values.
+func TestPasswordGrantValues(t *testing.T) {
+	tests := []struct {
+		name           string
+		format         UsernameFormat
+		domain         string
+		expectedUser   string
+		expectedDomain string
+	}{
+		{"Separate", UsernameFormatSeparate, "CORP", "test_user", "CORP"},
+		{"UPN", UsernameFormatUPN, "corp.example.com", "test_user@corp.example.com", ""},
+		{"DownLevel", UsernameFormatDownLevel, "CORP", `CORP\test_user`, ""},
+		{"NoDomain", UsernameFormatDownLevel, "", "test_user", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tss, err := New(Configuration{
+				Credentials: UserCredential{
+					Domain:   tt.domain,
+					Username: "test_user",
+					Password: "test_password",
+				},
+				ServerURL: "https://example.local/SecretServer",
+			}, WithUsernameFormat(tt.format))
+			if err != nil {
+				t.Fatal("configuring the Server:", err)
+			}
+
+			values := tss.passwordGrantValues()
+			validate("username", tt.expectedUser, values.Get("username"), t)
+			validate("domain", tt.expectedDomain, values.Get("domain"), t)
+			validate("password", "test_password", values.Get("password"), t)
+			validate("grant_type", "password", values.Get("grant_type"), t)
+			if _, found := values["domain"]; found && tt.expectedDomain == "" {
+				t.Error("expected no domain form field")
+			}
+		})
+	}
+}
+
+// TestConfigurationValidate asserts that Validate rejects each invalid
+// combination and normalizes a valid configuration.
+func TestConfigurationValidate(t *testing.T) {
+	credentials := UserCredential{Username: "test_user", Password: "test_password"}
+
+	invalid := []struct {
+		name   string
+		config Configuration
+	}{
+		{"Neither", Configuration{Credentials: credentials}},
+		{"Both", Configuration{Credentials: credentials, ServerURL: "https://example.local", Tenant: "example"}},
+		{"NoScheme", Configuration{Credentials: credentials, ServerURL: "example.local/SecretServer"}},
+		{"BadScheme", Configuration{Credentials: credentials, ServerURL: "ftp://example.local"}},
+		{"NoHost", Configuration{Credentials: credentials, ServerURL: "https:///SecretServer"}},
+		{"BadTenant", Configuration{Credentials: credentials, Tenant: "bad_tenant!"}},
+		{"BadTLD", Configuration{Credentials: credentials, Tenant: "example", TLD: "c0m/"}},
+		{"NoCredentials", Configuration{Credentials: UserCredential{Username: "test_user"}, Tenant: "example"}},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); err == nil {
+				t.Errorf("expected an error validating %+v", tt.config)
+			}
+			if _, err := New(tt.config); err == nil {
+				t.Errorf("expected New to reject %+v", tt.config)
+			}
+		})
+	}
+
+	// a Tenant which is not a bare label fails with an error saying why
+	for _, tt := range []struct {
+		name, tenant, message string
+	}{
+		{"TenantURL", "https://example.secretservercloud.com", "not a URL"},
+		{"TenantSlash", "example/SecretServer", "slashes"},
+		{"TenantHost", "example.secretservercloud.com", "without the secretservercloud domain"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(Configuration{Credentials: credentials, Tenant: tt.tenant})
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("expected an error saying '%s' for the Tenant '%s', but got '%v'", tt.message, tt.tenant, err)
+			}
+		})
+	}
+	if _, err := New(Configuration{Credentials: credentials, Tenant: "my-tenant-01"}); err != nil {
+		t.Error("configuring a Server with a valid Tenant:", err)
+	}
+
+	config := Configuration{Credentials: credentials, ServerURL: " https://example.local/SecretServer/ "}
+	if err := config.Validate(); err != nil {
+		t.Fatal("validating a valid configuration:", err)
+	}
+	validate("normalized ServerURL", "https://example.local/SecretServer", config.ServerURL, t)
+
+	config = Configuration{Credentials: UserCredential{Token: "static_token"}, Tenant: "example", TLD: ".com.au"}
+	if err := config.Validate(); err != nil {
+		t.Fatal("validating a valid cloud configuration:", err)
+	}
+	validate("normalized TLD", "com.au", config.TLD, t)
+}
+
+// TestClientCredentials asserts that WithClientCredentials posts the
+// client_credentials grant to the token endpoint, even when the Configuration
+// has no other credentials.
+func TestClientCredentials(t *testing.T) {
+	ctx := context.Background()
+	var grant url.Values
+
+	_, ts := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error("parsing the token request:", err)
+		}
+		grant = r.PostForm
+		grantTestToken(w, r)
+	}), http.NotFoundHandler())
+
+	tss, err := New(Configuration{ServerURL: ts.URL}, WithClientCredentials("test_client", "test_secret"))
+	if err != nil {
+		t.Fatal("configuring the Server:", err)
+	}
+	defer tss.clearTokenCache(ctx)
+
+	token, err := tss.getAccessToken(ctx)
+	if err != nil {
+		t.Fatal("calling server.getAccessToken:", err)
+	}
+	validate("access token", "test_token", token, t)
+	validate("grant_type", "client_credentials", grant.Get("grant_type"), t)
+	validate("client_id", "test_client", grant.Get("client_id"), t)
+	validate("client_secret", "test_secret", grant.Get("client_secret"), t)
+	for _, key := range []string{"username", "password"} {
+		if _, found := grant[key]; found {
+			t.Errorf("expected no '%s' in the client credentials grant", key)
+		}
+	}
+}
+
+// TestEndpointOverride asserts that WithEndpointOverride routes only the
+// overridden resources to their base URLs.
+func TestEndpointOverride(t *testing.T) {
+	ctx := context.Background()
+	tss, err := New(Configuration{
+		Credentials: UserCredential{Token: "static_token"},
+		ServerURL:   "https://example.local/SecretServer",
+	}, WithEndpointOverride(map[string]string{
+		"secrets": "https://secrets.mock.local/",
+		"token":   "https://auth.mock.local",
+	}))
+	if err != nil {
+		t.Fatal("configuring the Server:", err)
+	}
+
+	validate("secrets URL", "https://secrets.mock.local/api/v1/secrets/1", mustURL(t)(tss.urlFor(ctx, "secrets", "1")), t)
+	validate("token URL", "https://auth.mock.local/oauth2/token", mustURL(t)(tss.urlFor(ctx, "token", "")), t)
+	validate("secret-templates URL", "https://example.local/SecretServer/api/v1/secret-templates/6", mustURL(t)(tss.urlFor(ctx, "secret-templates", "6")), t)
+
+	searchURL := mustURL(t)(tss.urlForSearch(ctx, "secrets", "text", "", SearchFilters{}, 0))
+	if !strings.HasPrefix(searchURL, "https://secrets.mock.local/api/v1/secrets?") {
+		t.Errorf("expected the search to use the secrets override, but found '%s'", searchURL)
+	}
+}
+
+// TestTenantResolver asserts that WithTenantResolver derives the base URL on
+// each request, and that the access tokens are cached per tenant.
+func TestTenantResolver(t *testing.T) {
+	type tenantKey struct{}
+	ctx := context.Background()
+	tss, err := New(Configuration{
+		Credentials: UserCredential{Username: "test_user", Password: "test_password"},
+	}, WithTenantResolver(func(ctx context.Context) (string, string, error) {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		if tenant == "" {
+			return "", "", errors.New("no tenant")
+		}
+		return tenant, "", nil
+	}))
+	if err != nil {
+		t.Fatal("configuring the Server:", err)
+	}
+
+	ctxA := context.WithValue(ctx, tenantKey{}, "tenant-a")
+	ctxB := context.WithValue(ctx, tenantKey{}, "tenant-b")
+	validate("tenant-a URL", "https://tenant-a.secretservercloud.com/api/v1/secrets/1", mustURL(t)(tss.urlFor(ctxA, "secrets", "1")), t)
+	validate("tenant-b URL", "https://tenant-b.secretservercloud.com/api/v1/secrets/1", mustURL(t)(tss.urlFor(ctxB, "secrets", "1")), t)
+
+	if _, err := tss.urlFor(ctx, "secrets", "1"); err == nil {
+		t.Error("expected the resolver error to be returned")
+	}
+
+	os.Setenv("SS_AT_"+url.QueryEscape("https://tenant-a.secretservercloud.com/"), "cached")
+	os.Setenv("SS_AT_"+url.QueryEscape("https://tenant-b.secretservercloud.com/"), "cached")
+	tss.clearTokenCache(ctxA)
+	validate("tenant-a cache", "", os.Getenv("SS_AT_"+url.QueryEscape("https://tenant-a.secretservercloud.com/")), t)
+	validate("tenant-b cache", "cached", os.Getenv("SS_AT_"+url.QueryEscape("https://tenant-b.secretservercloud.com/")), t)
+	tss.clearTokenCache(ctxB)
+
+	if _, err := New(Configuration{
+		Credentials: UserCredential{Token: "static_token"},
+		ServerURL:   "https://example.local/SecretServer",
+	}, WithTenantResolver(func(context.Context) (string, string, error) { return "tenant-a", "", nil })); err == nil {
+		t.Error("expected an error for a resolver with a ServerURL")
+	}
+	if _, err := New(Configuration{Credentials: UserCredential{Token: "static_token"}}); err == nil {
+		t.Error("expected an error without a ServerURL, Tenant or resolver")
+	}
+}
+
+// TestUnknownResource asserts that requests for an unsupported resource fail
+// with ErrUnknownResource.
+func TestUnknownResource(t *testing.T) {
+	ctx := context.Background()
+	tss, _ := newTestServer(t, http.NotFoundHandler())
+
+	if _, err := tss.accessResource(ctx, http.MethodGet, "bogus", "1", nil); !errors.Is(err, ErrUnknownResource) {
+		t.Errorf("expected ErrUnknownResource from accessResource, but got '%v'", err)
+	}
+	if _, err := tss.searchResources(ctx, "bogus", "text", "", SearchFilters{}, 0); !errors.Is(err, ErrUnknownResource) {
+		t.Errorf("expected ErrUnknownResource from searchResources, but got '%v'", err)
+	}
+}
+
+// TestStaticTokenRefresher asserts that a static token which is rejected with
+// a 401 is replaced by the refresher and the request is retried once, for
+// searches as well as for the other requests.
+func TestStaticTokenRefresher(t *testing.T) {
+	var refreshes int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/api/v1/secrets" {
+			w.Write([]byte(`{"hasNext": false, "records": [{"id": 1}]}`))
+			return
+		}
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	}))
+	defer ts.Close()
+
+	newServer := func() *Server {
+		tss, err := New(Configuration{
+			Credentials: UserCredential{Token: "expired_token"},
+			ServerURL:   ts.URL,
+		}, WithStaticTokenRefresher(func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&refreshes, 1)
+			return "fresh_token", nil
+		}))
+		if err != nil {
+			t.Fatal("configuring the Server:", err)
+		}
+		return tss
+	}
+
+	tss := newServer()
+	for i := 0; i < 2; i++ {
+		secret, err := tss.Secret(context.Background(), 1)
+		if err != nil {
+			t.Fatal("calling server.Secret:", err)
+		}
+		validate("secret name", "Test Secret", secret.Name, t)
+	}
+	validate("refreshes", int32(1), atomic.LoadInt32(&refreshes), t)
+
+	secrets, err := newServer().Secrets(context.Background(), "Test", "")
+	if err != nil {
+		t.Fatal("calling server.Secrets:", err)
+	}
+	validate("searched secrets", 1, len(secrets), t)
+	validate("refreshes", int32(2), atomic.LoadInt32(&refreshes), t)
+}
+
+// TestUserAgent asserts that API requests carry the SDK User-Agent.
+func TestUserAgent(t *testing.T) {
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validate("User-Agent", "tss-sdk-go/"+SDKVersion(), r.UserAgent(), t)
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	}))
+
+	if _, err := tss.Secret(context.Background(), 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+}
+
+// recordingRoundTripper records the requests it passes on to http.DefaultTransport
+type recordingRoundTripper struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, req.Method+" "+req.URL.Path)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// TestWithRoundTripper asserts that the round tripper set by WithRoundTripper
+// carries the health check, token and API requests, and that a TLSClientConfig is applied
+// without mutating http.DefaultTransport.
+func TestWithRoundTripper(t *testing.T) {
+	rt := new(recordingRoundTripper)
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	}), WithRoundTripper(rt))
+
+	if _, err := tss.Secret(context.Background(), 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+	// the health check also goes through the round tripper
+	expected := []string{"GET /healthcheck.aspx", "POST /oauth2/token", "GET /api/v1/secrets/1"}
+	if len(rt.requests) != len(expected) {
+		t.Fatalf("expected the requests %v, but recorded %v", expected, rt.requests)
+	}
+	for i, request := range rt.requests {
+		validate("recorded request", expected[i], request, t)
+	}
+
+	config := Configuration{
+		Credentials:     UserCredential{Token: "static_token"},
+		ServerURL:       "https://example.local/SecretServer",
+		TLSClientConfig: &tls.Config{ServerName: "example.local"},
+	}
+	tlsServer, err := New(config)
+	if err != nil {
+		t.Fatal("configuring the Server with a TLSClientConfig:", err)
+	}
+	transport, ok := tlsServer.httpClient.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig != config.TLSClientConfig {
+		t.Error("expected the TLSClientConfig to be applied to the transport")
+	}
+	if defaultTransport := http.DefaultTransport.(*http.Transport); defaultTransport.TLSClientConfig == config.TLSClientConfig {
+		t.Error("expected http.DefaultTransport to be left unchanged")
+	}
+
+	if _, err := New(config, WithRoundTripper(rt)); err == nil {
+		t.Error("expected an error applying a TLSClientConfig to a round tripper which is not an *http.Transport")
+	}
+}
+
+// TestWithDialer asserts that the connections of the Server are opened with the
+// dialer set by WithDialer, which is applied along with a TLSClientConfig.
+func TestWithDialer(t *testing.T) {
+	var dials int32
+	dialer := &net.Dialer{
+		FallbackDelay: -1,
+		Control: func(network, address string, c syscall.RawConn) error {
+			atomic.AddInt32(&dials, 1)
+			return nil
+		},
+	}
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	}), WithDialer(dialer))
+
+	if _, err := tss.Secret(context.Background(), 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+	if atomic.LoadInt32(&dials) == 0 {
+		t.Error("expected the dialer to be invoked")
+	}
+
+	config := Configuration{
+		Credentials:     UserCredential{Token: "static_token"},
+		ServerURL:       "https://example.local/SecretServer",
+		TLSClientConfig: &tls.Config{ServerName: "example.local"},
+	}
+	tlsServer, err := New(config, WithDialer(dialer))
+	if err != nil {
+		t.Fatal("configuring the Server with a TLSClientConfig and a dialer:", err)
+	}
+	transport, ok := tlsServer.httpClient.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig != config.TLSClientConfig || transport.DialContext == nil {
+		t.Error("expected the TLSClientConfig and the dialer to be applied to the transport")
+	}
+	if transport != nil && transport.Proxy == nil {
+		t.Error("expected the proxy settings of the transport to be kept")
+	}
+}
+
+// TestDisableTokenCache asserts that each request obtains its own token grant
+// when WithDisableTokenCache is set.
+func TestDisableTokenCache(t *testing.T) {
+	var grants int32
+	tss, ts := newTestServerWithToken(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&grants, 1)
+		grantTestToken(w, r)
+	}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	}), WithDisableTokenCache())
+
+	const requests = 3
+	for i := 0; i < requests; i++ {
+		if _, err := tss.Secret(context.Background(), 1); err != nil {
+			t.Fatal("calling server.Secret:", err)
+		}
+	}
+	validate("token grants", int32(requests), atomic.LoadInt32(&grants), t)
+	if cached := os.Getenv("SS_AT_" + url.QueryEscape(ts.URL)); cached != "" {
+		t.Errorf("expected no token to be cached, but found '%s'", cached)
+	}
+}
+
+// TestPlatformVaultsRetry asserts that a transient failure of the platform
+// vaults request is retried with the same platform token, and that a
+// non-transient failure is not.
+func TestPlatformVaultsRetry(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		status    int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"transient", http.StatusServiceUnavailable, false, 2},
+		{"bad gateway", http.StatusBadGateway, false, 2},
+		{"gateway timeout", http.StatusGatewayTimeout, false, 2},
+		{"non-transient", http.StatusBadRequest, true, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var grants, vaultCalls int32
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/healthcheck.aspx", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"healthy": false}`))
+			})
+			mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"healthy": true}`))
+			})
+			mux.HandleFunc("/identity/api/oauth2/token/xpmplatform", func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&grants, 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"access_token": "platform_token", "token_type": "bearer", "expires_in": 1200}`))
+			})
+			ts := httptest.NewServer(mux)
+			t.Cleanup(ts.Close)
+			mux.HandleFunc("/vaultbroker/api/vaults", func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&vaultCalls, 1) == 1 {
+					w.WriteHeader(test.status)
+					return
+				}
+				validate("vaults authorization", "Bearer platform_token", r.Header.Get("Authorization"), t)
+				fmt.Fprintf(w, `{"vaults": [{"isDefault": true, "isActive": true, "connection": {"url": "%s/vault"}}]}`, ts.URL)
+			})
+
+			tss, err := New(Configuration{
+				Credentials: UserCredential{Username: "test_client", Password: "test_secret"},
+				ServerURL:   ts.URL,
+			}, WithBackoff(ConstantBackoff{Delay: time.Millisecond}))
+			if err != nil {
+				t.Fatal("configuring the Server:", err)
+			}
+			t.Cleanup(func() { os.Setenv("SS_AT_"+url.QueryEscape(ts.URL), "") })
+
+			token, err := tss.getAccessToken(context.Background())
+			if test.wantErr {
+				if err == nil {
+					t.Error("expected an error from a non-transient vaults failure")
+				}
+			} else {
+				if err != nil {
+					t.Fatal("calling server.getAccessToken:", err)
+				}
+				validate("access token", "platform_token", token, t)
+				validate("server URL", ts.URL+"/vault", tss.ServerURL, t)
+			}
+			validate("token grants", int32(1), atomic.LoadInt32(&grants), t)
+			validate("vaults requests", test.wantCalls, atomic.LoadInt32(&vaultCalls), t)
+		})
+	}
+}
+
+// TestPlatformDetectionErrors asserts that when neither health check succeeds
+// the error says why each failed, for a host which does not resolve and for
+// endpoints which both return a 500.
+func TestPlatformDetectionErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(ts.Close)
+
+	for _, test := range []struct {
+		name, serverURL string
+		messages        []string
+	}{
+		{"DNSFailure", "https://tss.invalid", []string{"tss.invalid/healthcheck.aspx", "tss.invalid/health:"}},
+		{"ServerError", ts.URL, []string{"/healthcheck.aspx: not healthy (500", "/health: not healthy (500"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tss, err := New(Configuration{
+				Credentials: UserCredential{Username: "test_user", Password: "test_password"},
+				ServerURL:   test.serverURL,
+			})
+			if err != nil {
+				t.Fatal("configuring the Server:", err)
+			}
+
+			_, err = tss.getAccessToken(context.Background())
+			if err == nil {
+				t.Fatal("expected an error when neither health check succeeds")
+			}
+			for _, message := range test.messages {
+				if !strings.Contains(err.Error(), message) {
+					t.Errorf("expected the error to contain '%s', but got '%s'", message, err)
+				}
+			}
+		})
+	}
+}
+
+// TestTokenCacheConcurrency asserts that concurrent writers and readers of the
+// token cache never observe a torn value. Run with -race.
+func TestTokenCacheConcurrency(t *testing.T) {
+	ctx := context.Background()
+	tss, err := New(Configuration{
+		Credentials: UserCredential{Username: "test_user", Password: "test_password"},
+		ServerURL:   "https://cache.example.local/SecretServer",
+	})
+	if err != nil {
+		t.Fatal("configuring the Server:", err)
+	}
+	defer tss.clearTokenCache(ctx)
+
+	tokens := []string{strings.Repeat("a", 512), strings.Repeat("b", 1024)}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(token string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tss.setCacheAccessToken(ctx, token, 1200, tss.ServerURL)
+			}
+		}(tokens[i%len(tokens)])
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				token, found := tss.getCacheAccessToken(ctx, tss.ServerURL)
+				if found && token != tokens[0] && token != tokens[1] {
+					t.Errorf("found a torn token of length %d", len(token))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestEachPage asserts that eachPage moves to the NextSkip of the server, or
+// past the records of a page whose NextSkip does not move forward, and stops
+// at the last page.
+func TestEachPage(t *testing.T) {
+	pages := map[int]*folderSearchResult{
+		0: {NextSkip: 2, HasNext: true, Records: make([]Folder, 2)},
+		2: {NextSkip: 0, HasNext: true, Records: make([]Folder, 3)},
+		5: {HasNext: false, Records: make([]Folder, 1)},
+	}
+	var skips []int
+	err := eachPage(func(skip int) (resultPage, error) {
+		skips = append(skips, skip)
+		page, found := pages[skip]
+		if !found {
+			return nil, fmt.Errorf("unexpected skip %d", skip)
+		}
+		return page, nil
+	})
+	if err != nil {
+		t.Fatal("calling eachPage:", err)
+	}
+	validate("skips", fmt.Sprint([]int{0, 2, 5}), fmt.Sprint(skips), t)
+}
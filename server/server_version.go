@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const versionResource = "version"
+
+// serverVersionCache holds the versions discovered by ServerVersion, keyed by
+// the base URL of Secret Server, so that the tenants of a tenant resolver are
+// kept apart
+type serverVersionCache struct {
+	mu       sync.Mutex
+	versions map[string]string
+}
+
+// versionResponse is the response of the version endpoint, which returns the
+// version within its model, or at the top level on some versions
+type versionResponse struct {
+	Version string
+	Model   struct {
+		Version string
+	}
+}
+
+// ServerVersion returns the version of Secret Server, such as "11.7.000002",
+// so that integrations can check for the availability of features. The version
+// is fetched once and cached for the lifetime of the Server.
+func (s *Server) ServerVersion(ctx context.Context) (string, error) {
+	l := s.log(ctx)
+
+	baseURL, err := s.serverBaseURL(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.versionCache.mu.Lock()
+	version, found := s.versionCache.versions[baseURL]
+	s.versionCache.mu.Unlock()
+	if found {
+		return version, nil
+	}
+
+	// the version is fetched without holding the lock, so that a slow request
+	// holds up neither the callers finding their version cached nor those of
+	// other tenants; concurrent first callers may each fetch it
+
+	data, err := s.accessResource(ctx, http.MethodGet, versionResource, "", nil)
+	if err != nil {
+		return "", err
+	}
+	response := new(versionResponse)
+	if err = json.Unmarshal(data, response); err != nil {
+		l.Error("error parsing version response", zap.String("data", string(data)))
+		return "", err
+	}
+	version = response.Model.Version
+	if version == "" {
+		version = response.Version
+	}
+	if version == "" {
+		l.Error("the version response has no version", zap.String("data", string(data)))
+		return "", errors.New("[ERROR] the version response has no version")
+	}
+
+	s.versionCache.mu.Lock()
+	if s.versionCache.versions == nil {
+		s.versionCache.versions = make(map[string]string)
+	}
+	s.versionCache.versions[baseURL] = version
+	s.versionCache.mu.Unlock()
+	l.Debug("discovered the server version", zap.String("version", version))
+	return version, nil
+}
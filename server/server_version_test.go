@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// TestServerVersion asserts that ServerVersion parses the version response and
+// caches the version, so that the second call makes no request.
+func TestServerVersion(t *testing.T) {
+	var requests int32
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/version" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"success": true, "model": {"version": "11.7.000002"}}`))
+	}))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		version, err := tss.ServerVersion(ctx)
+		if err != nil {
+			t.Fatal("calling server.ServerVersion:", err)
+		}
+		validate("version", "11.7.000002", version, t)
+	}
+	validate("version requests", int32(1), atomic.LoadInt32(&requests), t)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenStore keeps the access tokens of one or more Servers, keyed by the base
+// URL of Secret Server and the user or client they are granted to, in place of
+// the process environment, along with the credentials issued to SDK clients by
+// WithSDKClientAuth. Sharing a store between Servers, including those of other
+// processes with an implementation backed by a shared cache, lets them reuse a
+// single token grant. A TokenStore must be safe for concurrent use.
+type TokenStore interface {
+	// Load returns the token stored under the key and when it expires,
+	// reporting false when there is none
+	Load(ctx context.Context, key string) (token string, expiresAt time.Time, ok bool)
+	// Store stores the token under the key until it expires; an entry with a
+	// zero expiresAt, such as the credential of an SDK client, never expires
+	Store(ctx context.Context, key, token string, expiresAt time.Time) error
+	// Delete removes the token stored under the key, if any
+	Delete(ctx context.Context, key string)
+}
+
+type storedToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// MemoryTokenStore is a TokenStore which keeps the tokens in memory, to share
+// them between the Servers of a process
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]storedToken
+}
+
+// NewMemoryTokenStore returns an empty MemoryTokenStore
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]storedToken)}
+}
+
+func (m *MemoryTokenStore) Load(ctx context.Context, key string) (string, time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.tokens[key]
+	return stored.token, stored.expiresAt, ok
+}
+
+func (m *MemoryTokenStore) Store(ctx context.Context, key, token string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[key] = storedToken{token: token, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *MemoryTokenStore) Delete(ctx context.Context, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, key)
+}
+
+// AcquireToken obtains an access token, from the cache when it holds one, and
+// returns it with the time until which the Server considers it valid, which is
+// zero when that is unknown, as for a static token or WithDisableTokenCache.
+//
+// A fleet of short-lived workers can authenticate once by having a coordinator
+// acquire the token and hand it to each worker, which configures it as its
+// Credentials.Token, or by sharing a TokenStore, set with WithTokenStore, so
+// that any Server with the same credentials which finds a valid token in the
+// store uses it.
+func (s *Server) AcquireToken(ctx context.Context) (string, time.Time, error) {
+	token, err := s.getAccessToken(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if s.staticToken() != "" {
+		return token, time.Time{}, nil
+	}
+	baseURL, err := s.serverBaseURL(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if cached, expiresAt, found := s.cachedAccessToken(ctx, baseURL); found && cached == token {
+		return token, expiresAt, nil
+	}
+	return token, time.Time{}, nil
+}
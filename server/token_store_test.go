@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSharedTokenStore asserts that a second Server sharing the TokenStore of
+// the first uses its cached token rather than obtaining a grant of its own, and
+// that a token from AcquireToken can be injected as Credentials.Token.
+func TestSharedTokenStore(t *testing.T) {
+	ctx := context.Background()
+	var grants int32
+	var authorizations []string
+	tokenHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&grants, 1)
+		grantTestToken(w, r)
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"id": 1, "name": "Test Secret", "items": []}`))
+	})
+
+	store := NewMemoryTokenStore()
+	first, ts := newTestServerWithToken(t, tokenHandler, handler, WithTokenStore(store))
+	token, expiresAt, err := first.AcquireToken(ctx)
+	if err != nil {
+		t.Fatal("calling server.AcquireToken:", err)
+	}
+	if token == "" || !expiresAt.After(time.Now()) {
+		t.Errorf("expected a token with an expiry in the future, but got '%s' expiring at %s", token, expiresAt)
+	}
+	if stored, _, ok := store.Load(ctx, first.tokenStoreKey(ts.URL)); !ok || stored != token {
+		t.Errorf("expected the token to be kept in the store, but found '%s'", stored)
+	}
+	if os.Getenv("SS_AT_"+url.QueryEscape(ts.URL)) != "" {
+		t.Error("expected the token not to be cached in the environment")
+	}
+
+	second, err := New(Configuration{
+		Credentials: UserCredential{Username: "test_user", Password: "test_password"},
+		ServerURL:   ts.URL,
+	}, WithTokenStore(store))
+	if err != nil {
+		t.Fatal("configuring the second Server:", err)
+	}
+	if _, err := second.Secret(ctx, 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+	validate("token grants", int32(1), atomic.LoadInt32(&grants), t)
+
+	worker, err := New(Configuration{Credentials: UserCredential{Token: token}, ServerURL: ts.URL})
+	if err != nil {
+		t.Fatal("configuring the worker Server:", err)
+	}
+	if _, err := worker.Secret(ctx, 1); err != nil {
+		t.Fatal("calling server.Secret:", err)
+	}
+	validate("token grants", int32(1), atomic.LoadInt32(&grants), t)
+	for _, authorization := range authorizations {
+		validate("authorization", "Bearer "+token, authorization, t)
+	}
+}
+
+// TestSharedTokenStorePrincipals asserts that Servers sharing a TokenStore
+// with different credentials each obtain their own token.
+func TestSharedTokenStorePrincipals(t *testing.T) {
+	ctx := context.Background()
+	tokenHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token_of_%s", "token_type": "bearer", "expires_in": 1200}`, r.PostForm.Get("username"))
+	})
+
+	store := NewMemoryTokenStore()
+	first, ts := newTestServerWithToken(t, tokenHandler, http.NotFoundHandler(), WithTokenStore(store))
+	if token, _, err := first.AcquireToken(ctx); err != nil || token != "token_of_test_user" {
+		t.Fatalf("expected the token of the first user, but got '%s' (%v)", token, err)
+	}
+
+	second, err := New(Configuration{
+		Credentials: UserCredential{Username: "other_user", Password: "other_password"},
+		ServerURL:   ts.URL,
+	}, WithTokenStore(store))
+	if err != nil {
+		t.Fatal("configuring the second Server:", err)
+	}
+	t.Cleanup(func() { second.clearTokenCache(ctx) })
+	if token, _, err := second.AcquireToken(ctx); err != nil || token != "token_of_other_user" {
+		t.Errorf("expected the token of the second user, but got '%s' (%v)", token, err)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// userResource is the HTTP URL path component for the users resource
+const userResource = "users"
+
+// User represents a user from Delinea Secret Server
+type User struct {
+	DisplayName, UserName, DomainName string
+	ID, DomainID                      int
+	Enabled                           bool
+	EmailAddress                      string
+}
+
+// CurrentUser gets the user which the access token of the Server belongs to
+func (s *Server) CurrentUser(ctx context.Context) (*User, error) {
+	user := new(User)
+
+	if data, err := s.accessResource(ctx, http.MethodGet, userResource, "current", nil); err == nil {
+		if err = json.Unmarshal(data, user); err != nil {
+			s.log(ctx).Error("error parsing current user response", zap.String("data", string(data)))
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return user, nil
+}
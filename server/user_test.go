@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// TestCurrentUser asserts that CurrentUser parses the current user response.
+func TestCurrentUser(t *testing.T) {
+	tss, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/users/current" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{
+			"id": 3,
+			"userName": "test_user",
+			"displayName": "Test User",
+			"domainId": 1,
+			"domainName": "EXAMPLE",
+			"enabled": true,
+			"emailAddress": "test_user@example.local"
+		}`))
+	}))
+
+	user, err := tss.CurrentUser(context.Background())
+	if err != nil {
+		t.Fatal("calling server.CurrentUser:", err)
+	}
+	validate("id", 3, user.ID, t)
+	validate("username", "test_user", user.UserName, t)
+	validate("display name", "Test User", user.DisplayName, t)
+	validate("domain", "EXAMPLE", user.DomainName, t)
+}